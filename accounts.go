@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	"github.com/cometbft/cometbft/crypto/secp256k1"
+)
+
+// signedTxPrefix starts the signed transactions. They have the form
+// signed:<base64 public key>!<nonce>!<base64 signature>!<tx>, where the signature is over
+// <chain ID>!<nonce>!<tx> and tx is any unsigned transaction. The nonce must be the nonce of the account
+// of the public key, which starts at 0 and is incremented by every signed transaction of the
+// account included in a block, even if tx fails.
+const signedTxPrefix = "signed:"
+
+// accountPrefix is the key prefix under which the nonces of the accounts are stored, by address.
+var accountPrefix = []byte("_acc/")
+
+type signedTx struct {
+	pubKey crypto.PubKey
+	nonce  uint64
+	sig    []byte
+	tx     []byte
+}
+
+func isSignedTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(signedTxPrefix))
+}
+
+// parseSignedTx parses a signed transaction, without verifying its signature. The key type is
+// inferred from the size of the public key.
+func parseSignedTx(tx []byte) (*signedTx, error) {
+	parts := bytes.SplitN(tx[len(signedTxPrefix):], []byte("!"), 4)
+	if len(parts) != 4 {
+		return nil, errors.New("expected signed:<base64 public key>!<nonce>!<base64 signature>!<tx>")
+	}
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("decoding public key: %w", err)
+	}
+	var pubKey crypto.PubKey
+	switch len(pubKeyBytes) {
+	case ed25519.PubKeySize:
+		pubKey = ed25519.PubKey(pubKeyBytes)
+	case secp256k1.PubKeySize:
+		pubKey = secp256k1.PubKey(pubKeyBytes)
+	default:
+		return nil, fmt.Errorf("public key of %d bytes is neither ed25519 nor secp256k1", len(pubKeyBytes))
+	}
+	nonce, err := strconv.ParseUint(string(parts[1]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing nonce: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	return &signedTx{pubKey: pubKey, nonce: nonce, sig: sig, tx: parts[3]}, nil
+}
+
+// verify verifies the signature of the transaction on the chain with the given ID.
+func (stx *signedTx) verify(chainID string) error {
+	if !stx.pubKey.VerifySignature(signBytes(chainID, stx.nonce, stx.tx), stx.sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// signBytes returns the bytes signed by the sender of tx with the given nonce. They hold the
+// chain ID, so that a transaction signed for a chain cannot be replayed on another one.
+func signBytes(chainID string, nonce uint64, tx []byte) []byte {
+	return append([]byte(chainID+"!"+strconv.FormatUint(nonce, 10)+"!"), tx...)
+}
+
+func accountKey(addr crypto.Address) []byte {
+	return append(append([]byte{}, accountPrefix...), addr...)
+}
+
+// loadNonce returns the nonce of the account with the given address, read with get.
+func loadNonce(get func(key []byte) ([]byte, error), addr crypto.Address) (uint64, error) {
+	bz, err := get(accountKey(addr))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	if len(bz) != 8 {
+		return 0, fmt.Errorf("invalid nonce of account %v", addr)
+	}
+	return binary.BigEndian.Uint64(bz), nil
+}
+
+// execSignedTx executes a signed transaction of the block. The nonce of the account is
+// incremented even if the signed transaction fails, so that it cannot be replayed.
+func (app *KVStoreApplication) execSignedTx(b *blockExec, tx []byte) (*abcitypes.ExecTxResult, error) {
+	stx, _ := parseSignedTx(tx)
+	addr := stx.pubKey.Address()
+	nonce, err := loadNonce(b.w.Get, addr)
+	if err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error loading nonce", "err", err)
+		return nil, err
+	}
+	if stx.nonce != nonce {
+		app.logger.Info("abci", "method", "FinalizeBlock", "msg", "invalid nonce", "address", addr, "nonce", stx.nonce, "expected", nonce)
+		return &abcitypes.ExecTxResult{Code: codeTypeInvalidNonce, Log: fmt.Sprintf("expected nonce %d, got %d", nonce, stx.nonce), Codespace: codespace}, nil
+	}
+	if err := b.w.Set(accountKey(addr), binary.BigEndian.AppendUint64(nil, nonce+1)); err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error storing nonce", "err", err)
+		return nil, err
+	}
+
+	result, err := app.execTx(b, stx.tx)
+	if err != nil || result.Code != codeTypeOK {
+		return result, err
+	}
+	event := abcitypes.Event{
+		Type: "account",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "address", Value: addr.String(), Index: true},
+			{Key: "nonce", Value: strconv.FormatUint(stx.nonce, 10), Index: true},
+		},
+	}
+	result.Events = append([]abcitypes.Event{event}, result.Events...)
+	return result, nil
+}
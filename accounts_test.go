@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	"github.com/cometbft/cometbft/crypto/secp256k1"
+
+	db "kvstore/database"
+)
+
+// signTx returns tx signed by priv with nonce on the chain with the given ID.
+func signTx(t *testing.T, priv crypto.PrivKey, chainID string, nonce uint64, tx string) string {
+	t.Helper()
+	sig, err := priv.Sign(signBytes(chainID, nonce, []byte(tx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s%s!%d!%s!%s", signedTxPrefix, base64.StdEncoding.EncodeToString(priv.PubKey().Bytes()),
+		nonce, base64.StdEncoding.EncodeToString(sig), tx)
+}
+
+func TestSignedTxs(t *testing.T) {
+	type signed struct {
+		chainID string // testChainID if empty
+		nonce   uint64
+		tx      string
+	}
+	testCases := []struct {
+		name      string
+		committed []signed // the transactions of the block committed before the others are checked
+		txs       []signed // the transactions checked in order, then finalized in a block
+		checks    []uint32 // the codes of CheckTx
+		results   []uint32 // the codes of FinalizeBlock
+		nonce     uint64   // the nonce of the account after the block
+		kvs       string
+	}{
+		{
+			name:    "first transaction",
+			txs:     []signed{{nonce: 0, tx: "a=1"}},
+			checks:  []uint32{codeTypeOK},
+			results: []uint32{codeTypeOK},
+			nonce:   1,
+			kvs:     "[a=1 k=1]",
+		},
+		{
+			name:    "sequence",
+			txs:     []signed{{nonce: 0, tx: "a=1"}, {nonce: 1, tx: "inc:a=1"}, {nonce: 2, tx: "del:k"}},
+			checks:  []uint32{codeTypeOK, codeTypeOK, codeTypeOK},
+			results: []uint32{codeTypeOK, codeTypeOK, codeTypeOK},
+			nonce:   3,
+			kvs:     "[a=2]",
+		},
+		{
+			name:    "wrong chain ID",
+			txs:     []signed{{chainID: "other-chain", nonce: 0, tx: "a=1"}},
+			checks:  []uint32{codeTypeInvalidSignature},
+			results: []uint32{codeTypeInvalidSignature},
+			nonce:   0,
+			kvs:     "[k=1]",
+		},
+		{
+			name:    "replay in the mempool and the block",
+			txs:     []signed{{nonce: 0, tx: "a=1"}, {nonce: 0, tx: "a=1"}},
+			checks:  []uint32{codeTypeOK, codeTypeInvalidNonce},
+			results: []uint32{codeTypeOK, codeTypeInvalidNonce},
+			nonce:   1,
+			kvs:     "[a=1 k=1]",
+		},
+		{
+			name:      "replay of a committed transaction",
+			committed: []signed{{nonce: 0, tx: "inc:k=1"}},
+			txs:       []signed{{nonce: 0, tx: "inc:k=1"}},
+			checks:    []uint32{codeTypeInvalidNonce},
+			results:   []uint32{codeTypeInvalidNonce},
+			nonce:     1,
+			kvs:       "[k=2]",
+		},
+		{
+			name:    "nonce gap",
+			txs:     []signed{{nonce: 1, tx: "a=1"}},
+			checks:  []uint32{codeTypeOK},
+			results: []uint32{codeTypeInvalidNonce},
+			nonce:   0,
+			kvs:     "[k=1]",
+		},
+		{
+			name:    "nonce gap filled in the mempool",
+			txs:     []signed{{nonce: 1, tx: "a=1"}, {nonce: 0, tx: "b=1"}},
+			checks:  []uint32{codeTypeOK, codeTypeOK},
+			results: []uint32{codeTypeInvalidNonce, codeTypeOK},
+			nonce:   1,
+			kvs:     "[b=1 k=1]",
+		},
+		{
+			name:    "failed transaction",
+			txs:     []signed{{nonce: 0, tx: "cas:k=2=3"}, {nonce: 0, tx: "a=1"}},
+			checks:  []uint32{codeTypeCompareFailed, codeTypeOK},
+			results: []uint32{codeTypeCompareFailed, codeTypeInvalidNonce},
+			nonce:   1,
+			kvs:     "[k=1]",
+		},
+	}
+	for _, tc := range testCases {
+		for _, priv := range []crypto.PrivKey{ed25519.GenPrivKey(), secp256k1.GenPrivKey()} {
+			t.Run(tc.name+"/"+priv.Type(), func(t *testing.T) {
+				sign := func(txs []signed) []string {
+					var signedTxs []string
+					for _, s := range txs {
+						chainID := s.chainID
+						if chainID == "" {
+							chainID = testChainID
+						}
+						signedTxs = append(signedTxs, signTx(t, priv, chainID, s.nonce, s.tx))
+					}
+					return signedTxs
+				}
+				app := newTestApp(t, DefaultConfig())
+				initChain(t, app, `{"kvs": {"k": "1"}}`)
+				height := int64(1)
+				if tc.committed != nil {
+					commitBlock(t, app, height, sign(tc.committed)...)
+					height++
+				}
+
+				txs := sign(tc.txs)
+				for i, tx := range txs {
+					check, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tx), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if check.Code != tc.checks[i] {
+						t.Fatalf("tx %d: CheckTx code %d (%s), want %d", i, check.Code, check.Log, tc.checks[i])
+					}
+				}
+				for i, result := range commitBlock(t, app, height, txs...) {
+					if result.Code != tc.results[i] {
+						t.Fatalf("tx %d: FinalizeBlock code %d (%s), want %d", i, result.Code, result.Log, tc.results[i])
+					}
+				}
+				nonce, err := loadNonce(func(key []byte) ([]byte, error) { return app.store.Get(key, db.LatestVersion) }, priv.PubKey().Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if nonce != tc.nonce {
+					t.Fatalf("account nonce %d, want %d", nonce, tc.nonce)
+				}
+				if kvs := userKVs(t, app); kvs != tc.kvs {
+					t.Fatalf("store %s, want %s", kvs, tc.kvs)
+				}
+			})
+		}
+	}
+}
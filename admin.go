@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync/atomic"
+
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+)
+
+// storeFaults makes the faults of the configuration the current ones, replacing the faults set
+// through the admin server.
+func (app *KVStoreApplication) storeFaults() {
+	voteExtensionFaults := app.cfg.VoteExtensionFaults
+	app.voteExtensionFaults.Store(&voteExtensionFaults)
+	nonDeterminism := app.cfg.NonDeterminism
+	app.nonDeterminism.Store(&nonDeterminism)
+	latencies := maps.Clone(app.cfg.Latencies)
+	app.latencies.Store(&latencies)
+	methodFaults := maps.Clone(app.cfg.MethodFaults)
+	app.methodFaults.Store(&methodFaults)
+}
+
+// serveAdmin serves the endpoints changing the faults of app at runtime on addr, see
+// adminHandler.
+func serveAdmin(addr string, app *KVStoreApplication) error {
+	return http.ListenAndServe(addr, adminHandler(app))
+}
+
+// adminHandler returns the handler of the endpoints changing the faults of app at runtime. Every
+// endpoint returns the current value as JSON on GET, and replaces it with the JSON body of a PUT:
+//
+//   - /faults/vote-extensions: VoteExtensionFaults
+//   - /faults/non-determinism: NonDeterminism
+//   - /faults/latency: Latencies
+//   - /faults/abci: MethodFaults
+func adminHandler(app *KVStoreApplication) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/faults/vote-extensions", faultHandler(&app.voteExtensionFaults, VoteExtensionFaults.validate, app.logger))
+	mux.Handle("/faults/non-determinism", faultHandler(&app.nonDeterminism, NonDeterminism.validate, app.logger))
+	mux.Handle("/faults/latency", faultHandler(&app.latencies, Latencies.validate, app.logger))
+	mux.Handle("/faults/abci", faultHandler(&app.methodFaults, MethodFaults.validate, app.logger))
+	return mux
+}
+
+// faultHandler returns the handler of the fault stored in p, which only stores valid faults.
+func faultHandler[T any](p *atomic.Pointer[T], validate func(T) error, logger cmtlog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, p.Load())
+		case http.MethodPut:
+			var fault T
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&fault); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validate(fault); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.Store(&fault)
+			logger.Info("admin", "msg", "fault changed", "path", r.URL.Path, "fault", fault)
+			writeJSON(w, &fault)
+		default:
+			http.Error(w, "expected GET or PUT", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
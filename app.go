@@ -3,37 +3,211 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
 	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtcrypto "github.com/cometbft/cometbft/api/cometbft/crypto/v1"
 	cmtlog "github.com/cometbft/cometbft/libs/log"
+	cmttypes "github.com/cometbft/cometbft/types"
 	"github.com/cometbft/cometbft/version"
+	"kvstore/crash"
 	db "kvstore/database"
+	"kvstore/smt"
+	"kvstore/snapshot"
+)
+
+var (
+	// kvPrefix is the key prefix under which the application key/value pairs are stored.
+	kvPrefix = []byte("kv/")
+
+	// kvChangesPrefix is the key prefix under which the heights the key/value pairs are written
+	// at are indexed, for pruning.
+	kvChangesPrefix = []byte("kvchanges/")
+)
+
+const (
+	codeTypeOK uint32 = iota
+	codeTypeInvalidTxFormat
+	codeTypeUnknownPath
+	codeTypeFutureHeight
+	codeTypePrunedHeight
+	codeTypeInternalError
+	codeTypeInvalidValidatorTx
+	codeTypeReservedKey
+	codeTypeInvalidParamsTx
+	codeTypeCompareFailed
+	codeTypeInvalidValue
+	codeTypeInvalidSignature
+	codeTypeInvalidNonce
+	codeTypeInvalidOracleTx
 )
 
+// codespace is the codespace of the codes of failed transactions.
+const codespace = "kvstore++"
+
+// codeNames are short descriptions of the codes of failed transactions.
+var codeNames = map[uint32]string{
+	codeTypeInvalidTxFormat:    "invalid transaction format",
+	codeTypeInternalError:      "internal error",
+	codeTypeInvalidValidatorTx: "invalid validator update",
+	codeTypeReservedKey:        "reserved key",
+	codeTypeInvalidParamsTx:    "invalid consensus params update",
+	codeTypeCompareFailed:      "compare-and-swap failed",
+	codeTypeInvalidValue:       "invalid value",
+	codeTypeInvalidSignature:   "invalid signature",
+	codeTypeInvalidNonce:       "invalid nonce",
+	codeTypeInvalidOracleTx:    "invalid oracle transaction",
+}
+
 type KVStoreApplication struct {
 	logger cmtlog.Logger
+	cfg    Config
 	db     *db.PebbleDB
-	batch  db.Batch
+	store  *db.VersionedDB
+
+	// state is the last committed state, and pending the block finalized on top of it and not
+	// yet committed, see beginBlock.
+	state   appState
+	pending *pendingBlock
+
+	// finalizedHeight is the height of the block that was finalized but not committed before
+	// the application restarted, 0 if there is none.
+	finalizedHeight int64
+
+	// initialHeight is the height of the first block of the chain, see loadInitialHeight.
+	initialHeight int64
+
+	// chainID is the ID of the chain, stored at InitChain, see loadGenesisConfig.
+	chainID string
+
+	// checkState is the state CheckTx checks transactions against, see resetCheckState.
+	checkState *opBatch
+
+	snapshots    *snapshot.Store
+	snapshotting atomic.Bool
+	restore      *restore
+
+	// retainHeight is the last retain height returned by Commit, and prunedHeight the retain
+	// height the state was last pruned at in the background, see maybePrune.
+	retainHeight int64
+	prunedHeight atomic.Int64
+	pruning      atomic.Bool
+
+	// treeMtx serializes the writes of committed blocks with the pruning of tree nodes, see
+	// smt.Prune.
+	treeMtx sync.Mutex
+
+	// voteExtensionFaults are the current vote extension faults, changed by the admin server.
+	voteExtensionFaults atomic.Pointer[VoteExtensionFaults]
+
+	// nonDeterminism is the current non-determinism mode, changed by the admin server.
+	nonDeterminism atomic.Pointer[NonDeterminism]
+
+	// latencies are the current delays of the ABCI methods, changed by the admin server.
+	latencies atomic.Pointer[Latencies]
+
+	// methodFaults are the current faults of the ABCI methods, changed by the admin server.
+	methodFaults atomic.Pointer[MethodFaults]
 }
 
 var _ abcitypes.Application = (*KVStoreApplication)(nil)
 
-func NewKVStoreApplication(db *db.PebbleDB, logger cmtlog.Logger) *KVStoreApplication {
-	return &KVStoreApplication{db: db, logger: logger}
+func NewKVStoreApplication(pebble *db.PebbleDB, snapshots *snapshot.Store, cfg Config, logger cmtlog.Logger) (*KVStoreApplication, error) {
+	state, err := loadState(pebble)
+	if err != nil {
+		return nil, err
+	}
+	app := &KVStoreApplication{
+		db:        pebble,
+		store:     db.NewVersionedDB(pebble, kvPrefix, kvChangesPrefix),
+		snapshots: snapshots,
+		cfg:       cfg,
+		logger:    logger,
+		state:     state,
+	}
+	if err := app.loadGenesisConfig(); err != nil {
+		return nil, err
+	}
+	if app.finalizedHeight, err = loadFinalizedHeight(pebble); err != nil {
+		return nil, err
+	}
+	if app.finalizedHeight > state.Height {
+		logger.Info("block was finalized but not committed before the restart, it will be finalized again",
+			"height", app.finalizedHeight, "last_committed_height", state.Height)
+	}
+	if app.retainHeight, err = loadRetainHeight(pebble); err != nil {
+		return nil, err
+	}
+	if app.initialHeight, err = loadInitialHeight(pebble); err != nil {
+		return nil, err
+	}
+	app.storeFaults()
+	app.resetCheckState()
+	return app, nil
 }
 
 func (app *KVStoreApplication) Info(_ context.Context, info *abcitypes.InfoRequest) (*abcitypes.InfoResponse, error) {
+	data, err := app.cfg.infoData()
+	if err != nil {
+		return nil, err
+	}
 	return &abcitypes.InfoResponse{
-		Data:       "kvstore++",
-		Version:    version.ABCIVersion,
-		AppVersion: version.BlockProtocol,
+		Data:             data,
+		Version:          version.ABCIVersion,
+		AppVersion:       version.BlockProtocol,
+		LastBlockHeight:  app.state.Height,
+		LastBlockAppHash: app.state.AppHash,
 	}, nil
 }
 
 func (app *KVStoreApplication) Query(_ context.Context, req *abcitypes.QueryRequest) (*abcitypes.QueryResponse, error) {
-	resp := abcitypes.QueryResponse{Key: req.Data}
+	height := req.Height
+	if height == 0 {
+		height = app.state.Height
+	}
+	resp := abcitypes.QueryResponse{Key: req.Data, Height: height}
+
+	if req.Path != "" && req.Path != "/key" {
+		resp.Code = codeTypeUnknownPath
+		resp.Log = fmt.Sprintf("unknown query path %q", req.Path)
+		return &resp, nil
+	}
+	if height > app.state.Height {
+		resp.Code = codeTypeFutureHeight
+		resp.Log = fmt.Sprintf("height %d is above the latest height %d", height, app.state.Height)
+		return &resp, nil
+	}
+	// The heights below the initial height have no state, but the genesis state before the first
+	// block. They fail like pruned heights, with their own log.
+	if height != app.state.Height && height < app.initialHeight {
+		resp.Code = codeTypePrunedHeight
+		resp.Log = fmt.Sprintf("height %d is below the initial height %d", height, app.initialHeight)
+		return &resp, nil
+	}
+	appHash := app.state.AppHash
+	if height != app.state.Height {
+		var err error
+		if appHash, err = loadAppHash(app.db, height); err != nil {
+			app.logger.Error("abci", "method", "Query", "msg", "error loading app hash", "height", height, "err", err)
+			resp.Code = codeTypeInternalError
+			resp.Log = "error loading app hash"
+			return &resp, nil
+		}
+		if appHash == nil {
+			resp.Code = codeTypePrunedHeight
+			resp.Log = fmt.Sprintf("height %d is not retained", height)
+			return &resp, nil
+		}
+	}
 
-	item, err := app.db.Get(req.Data)
+	item, err := app.store.Get(req.Data, height)
 	if err != nil {
 		resp.Log = "error getting value from application"
 	} else {
@@ -46,100 +220,555 @@ func (app *KVStoreApplication) Query(_ context.Context, req *abcitypes.QueryRequ
 		}
 	}
 
+	if req.Prove {
+		proof, err := smt.NewTree(app.db, appHash).Prove(req.Data)
+		if err != nil {
+			app.logger.Error("abci", "method", "Query", "msg", "error building proof", "err", err)
+			resp.Code = codeTypeInternalError
+			resp.Log = "error building proof"
+			return &resp, nil
+		}
+		op := smt.NewProofOp(req.Data, proof).ProofOp()
+		resp.ProofOps = &cmtcrypto.ProofOps{Ops: []cmtcrypto.ProofOp{op}}
+	}
+
 	return &resp, nil
 }
 
 func (app *KVStoreApplication) CheckTx(_ context.Context, check *abcitypes.CheckTxRequest) (*abcitypes.CheckTxResponse, error) {
-	code := app.isValid(check.Tx)
-	return &abcitypes.CheckTxResponse{Code: code}, nil
+	code, err := app.checkTx(app.checkState, check.Tx)
+	if code != codeTypeOK {
+		if check.Type == abcitypes.CHECK_TX_TYPE_RECHECK {
+			app.logger.Info("abci", "method", "CheckTx", "msg", "tx no longer valid after recheck", "code", code, "err", err)
+		}
+		return &abcitypes.CheckTxResponse{Code: code, Log: err.Error(), Info: codeNames[code], Codespace: codespace}, nil
+	}
+
+	// The mempool of CometBFT has no priorities nor lanes, they are reported in an event for the
+	// load tests and the proposal strategies to use.
+	meta := getTxMeta(check.Tx)
+	attrs := []abcitypes.EventAttribute{{Key: "priority", Value: strconv.FormatInt(meta.priority, 10)}}
+	if meta.sender != nil {
+		attrs = append(attrs, abcitypes.EventAttribute{Key: "sender", Value: meta.sender.String()})
+	}
+	if lane := app.cfg.lane(meta); lane != "" {
+		attrs = append(attrs, abcitypes.EventAttribute{Key: "lane", Value: lane})
+	}
+	return &abcitypes.CheckTxResponse{
+		Code:      code,
+		GasWanted: meta.gas,
+		Events:    []abcitypes.Event{{Type: "tx", Attributes: attrs}},
+	}, nil
 }
 
 func (app *KVStoreApplication) InitChain(_ context.Context, chain *abcitypes.InitChainRequest) (*abcitypes.InitChainResponse, error) {
-	return &abcitypes.InitChainResponse{}, nil
+	if app.state.Height != 0 || app.pending != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "chain already initialized", "height", app.state.Height)
+		return nil, fmt.Errorf("cannot initialize the chain, the last committed block is %d", app.state.Height)
+	}
+	genesis, err := parseGenesisState(chain.AppStateBytes)
+	if err != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "invalid app_state", "err", err)
+		return nil, err
+	}
+	// The configuration of the genesis is checked with the one of this node before anything is
+	// written, loadGenesisConfig fails on the same errors once it is.
+	if _, err := app.cfg.withGenesisConfig(genesis.Config); err != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "invalid config", "err", err)
+		return nil, err
+	}
+	params, paramsUpdate, err := genesis.consensusParams(chain.ConsensusParams)
+	if err != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "invalid consensus params", "err", err)
+		return nil, err
+	}
+	validators := chain.Validators
+	var validatorsUpdate []abcitypes.ValidatorUpdate
+	if len(genesis.Validators) != 0 {
+		if validatorsUpdate, err = genesis.validators(params.GetValidator().GetPubKeyTypes()); err != nil {
+			app.logger.Error("abci", "method", "InitChain", "msg", "invalid validators", "err", err)
+			return nil, err
+		}
+		validators = validatorsUpdate
+	}
+
+	batch := app.db.NewBatch()
+	defer batch.Close()
+
+	// The genesis state is written at version 0, below every block height.
+	w := &stateWriter{store: app.store, batch: batch, tree: smt.NewTree(app.db, nil), version: 0}
+	if params != nil {
+		if err := saveConsensusParams(w, params); err != nil {
+			return nil, err
+		}
+	}
+	vals := validatorSet{}
+	for _, val := range validators {
+		if err := vals.apply(w, val); err != nil {
+			app.logger.Error("abci", "method", "InitChain", "msg", "error storing validator", "err", err)
+			return nil, err
+		}
+	}
+	// CometBFT sends an initial height of 0 when the genesis file has none, the chain then
+	// starts at height 1.
+	initialHeight := max(chain.InitialHeight, 1)
+	if err := saveValidatorSet(w, vals, initialHeight); err != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "error storing validator set", "err", err)
+		return nil, err
+	}
+	for key, value := range genesis.KVs {
+		if err := w.Set([]byte(key), []byte(value)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Set(chainIDKey, []byte(chain.ChainId)); err != nil {
+		return nil, err
+	}
+	if len(genesis.Config) != 0 {
+		if err := w.Set(configKey, genesis.Config); err != nil {
+			return nil, err
+		}
+	}
+	appHash, err := w.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	state := appState{AppHash: appHash}
+	if err := state.save(batch); err != nil {
+		return nil, err
+	}
+	if err := batch.Set(initialHeightKey, binary.BigEndian.AppendUint64(nil, uint64(initialHeight))); err != nil {
+		return nil, err
+	}
+	if err := batch.WriteSync(); err != nil {
+		app.logger.Error("abci", "method", "InitChain", "msg", "error writing genesis state", "err", err)
+		return nil, err
+	}
+	app.state = state
+	app.initialHeight = initialHeight
+	if err := app.loadGenesisConfig(); err != nil {
+		return nil, err
+	}
+	// The faults of the genesis configuration apply from the start of the chain. They are not
+	// applied again after a restore, which would replace the faults set through the admin server.
+	app.storeFaults()
+	app.logger.Info("abci", "method", "InitChain", "msg", "genesis state stored", "validators", len(vals),
+		"kvs", len(genesis.KVs), "app_hash", fmt.Sprintf("%X", appHash))
+	return &abcitypes.InitChainResponse{
+		ConsensusParams: paramsUpdate,
+		Validators:      validatorsUpdate,
+		AppHash:         appHash,
+	}, nil
 }
 
 func (app *KVStoreApplication) PrepareProposal(_ context.Context, proposal *abcitypes.PrepareProposalRequest) (*abcitypes.PrepareProposalResponse, error) {
-	return &abcitypes.PrepareProposalResponse{Txs: proposal.Txs}, nil
+	oracleTx, err := app.newOracleTx(proposal)
+	if err != nil {
+		app.logger.Error("abci", "method", "PrepareProposal", "msg", "error aggregating vote extensions", "err", err)
+		return nil, err
+	}
+	// The oracle transaction comes first, the strategies choose the others in the space left.
+	req := *proposal
+	if oracleTx != nil {
+		size := cmttypes.ComputeProtoSizeForTxs([]cmttypes.Tx{oracleTx})
+		if size > req.MaxTxBytes {
+			app.logger.Error("abci", "method", "PrepareProposal", "msg", "dropping oracle tx larger than the proposal",
+				"height", proposal.Height, "size", size, "max_tx_bytes", req.MaxTxBytes)
+			oracleTx = nil
+		} else {
+			req.MaxTxBytes -= size
+		}
+	}
+	txs := proposal.Txs
+	for _, name := range app.cfg.ProposalStrategies {
+		txs = proposalStrategies[name](app, &req, txs)
+	}
+	// The strategies can add transactions, whatever their order the proposal must fit in
+	// MaxTxBytes.
+	txs = maxTxBytesStrategy(app, &req, txs)
+	if oracleTx != nil {
+		txs = append([][]byte{oracleTx}, txs...)
+	}
+	return &abcitypes.PrepareProposalResponse{Txs: txs}, nil
 }
 
 func (app *KVStoreApplication) ProcessProposal(_ context.Context, proposal *abcitypes.ProcessProposalRequest) (*abcitypes.ProcessProposalResponse, error) {
-	return &abcitypes.ProcessProposalResponse{Status: abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT}, nil
+	status := abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT
+	reason, details := app.proposalRejection(proposal)
+	if reason != "" {
+		status = abcitypes.PROCESS_PROPOSAL_STATUS_REJECT
+	}
+	app.logger.Info("abci", "method", "ProcessProposal", "height", proposal.Height, "proposer", fmt.Sprintf("%X", proposal.ProposerAddress),
+		"txs", len(proposal.Txs), "status", status, "reason", reason, "details", details)
+	processedProposals.WithLabelValues(status.String(), reason).Inc()
+	return &abcitypes.ProcessProposalResponse{Status: status}, nil
 }
 
 func (app *KVStoreApplication) FinalizeBlock(_ context.Context, req *abcitypes.FinalizeBlockRequest) (*abcitypes.FinalizeBlockResponse, error) {
+	crash.SetHeight(req.Height)
+	if err := app.beginBlock(req.Height); err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "rejecting block", "err", err)
+		return nil, err
+	}
+
+	// Transactions read the writes of the previous transactions of the block through the
+	// indexed batch, before it is written in Commit.
+	batch := app.db.NewIndexedBatch()
+	resp, state, err := app.executeBlock(req, batch)
+	if err != nil {
+		batch.Close()
+		return nil, err
+	}
+	if err := app.db.SetSync(finalizedKey, binary.BigEndian.AppendUint64(nil, uint64(req.Height))); err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error recording finalized height", "err", err)
+		batch.Close()
+		return nil, err
+	}
+	app.pending = &pendingBlock{state: state, batch: batch}
+	crash.Here(crash.FinalizeBlockEnd)
+	return resp, nil
+}
+
+// executeBlock executes the block with batch, and returns the response of FinalizeBlock with the
+// state the block leaves once it is committed.
+func (app *KVStoreApplication) executeBlock(req *abcitypes.FinalizeBlockRequest, batch *db.IndexedBatch) (*abcitypes.FinalizeBlockResponse, appState, error) {
 	var txsResults = make([]*abcitypes.ExecTxResult, len(req.Txs))
+	w := &stateWriter{store: app.store.WithReader(batch), batch: batch, tree: smt.NewTree(app.db, app.state.AppHash), version: req.Height}
+	vals, err := app.loadValidators(db.LatestVersion)
+	if err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error loading validators", "err", err)
+		return nil, appState{}, err
+	}
+	params, err := app.loadConsensusParams(db.LatestVersion)
+	if err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error loading consensus params", "err", err)
+		return nil, appState{}, err
+	}
+	// The transactions update vals, the updates are merged against the set before them.
+	initialVals := maps.Clone(vals)
+	b := &blockExec{height: req.Height, w: w, vals: vals, params: params, paramsUpdate: newParamsUpdate(params)}
 
-	app.batch = app.db.NewBatch()
 	for i, tx := range req.Txs {
-		if code := app.isValid(tx); code != 0 {
-			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid tx", "code", code)
-			txsResults[i] = &abcitypes.ExecTxResult{Code: code}
-		} else {
-			parts := bytes.SplitN(tx, []byte("="), 2)
-			key, value := parts[0], parts[1]
-			err := app.batch.Set(key, value)
-			if err != nil {
-				app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error setting batch", "code", code)
-				return nil, err
-			}
-			txsResults[i] = &abcitypes.ExecTxResult{
-				Code: 0,
-				Events: []abcitypes.Event{
-					{
-						Type: "event",
-						Attributes: []abcitypes.EventAttribute{
-							{Key: "key", Value: string(key), Index: true},
-							{Key: "value", Value: string(value), Index: true},
-						},
-					},
-				},
-			}
-		}
-	}
-
-	return &abcitypes.FinalizeBlockResponse{
-		TxResults: txsResults,
-	}, nil
+		b.index, b.tx = i, tx
+		if txsResults[i], err = app.execTx(b, tx); err != nil {
+			return nil, appState{}, err
+		}
+	}
+
+	// The updates of the validators apply two heights later.
+	if len(b.valUpdates) > 0 {
+		if err := saveValidatorSet(w, b.vals, req.Height+2); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error storing validator set", "err", err)
+			return nil, appState{}, err
+		}
+	}
+
+	// The parameters are stored as they apply from the next height on, like the validators.
+	paramUpdates := b.paramsUpdate.proto()
+	if paramUpdates != nil {
+		next := b.paramsUpdate.next.ToProto()
+		if err := saveConsensusParams(w, &next); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error storing consensus params", "err", err)
+			return nil, appState{}, err
+		}
+	}
+
+	nonDeterminism := app.nonDeterminism.Load().at(req.Height)
+	if nonDeterminism != NonDeterminismNone {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "injecting non-determinism", "height", req.Height, "mode", nonDeterminism)
+	}
+	if nonDeterminism == NonDeterminismValue {
+		if err := writeRandomValue(w); err != nil {
+			return nil, appState{}, err
+		}
+	}
+
+	appHash, err := w.finish()
+	if err != nil {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error writing tree", "err", err)
+		return nil, appState{}, err
+	}
+	state := appState{Height: req.Height, AppHash: appHash}
+
+	resp := &abcitypes.FinalizeBlockResponse{
+		TxResults:             txsResults,
+		ValidatorUpdates:      mergeValidatorUpdates(initialVals, b.valUpdates),
+		ConsensusParamUpdates: paramUpdates,
+		AppHash:               appHash,
+	}
+	switch nonDeterminism {
+	case NonDeterminismAppHash:
+		resp.AppHash = alteredAppHash(resp.AppHash)
+	case NonDeterminismTxResults:
+		swapResultCodes(resp.TxResults)
+	}
+	return resp, state, nil
 }
 
 func (app *KVStoreApplication) Commit(_ context.Context, commit *abcitypes.CommitRequest) (*abcitypes.CommitResponse, error) {
-	err := app.batch.Write()
+	crash.Here(crash.CommitStart)
+	p := app.pending
+	if p == nil {
+		app.logger.Error("abci", "method", "Commit", "msg", "no finalized block to commit", "height", app.state.Height)
+		return nil, fmt.Errorf("no finalized block to commit, the last committed block is %d", app.state.Height)
+	}
+	if err := p.state.save(p.batch); err != nil {
+		app.logger.Error("abci", "method", "Commit", "msg", "error saving state", "err", err)
+		return nil, errors.New("error during commit")
+	}
+	if err := p.batch.Delete(finalizedKey); err != nil {
+		return nil, err
+	}
+	retainHeight := app.nextRetainHeight(p.state.Height)
+	if retainHeight != app.retainHeight {
+		if err := saveRetainHeight(p.batch, retainHeight); err != nil {
+			return nil, err
+		}
+	}
+	crash.Here(crash.CommitBeforeWrite)
+	// The block is synced, so that the application never restarts below the height CometBFT
+	// saw it commit, whatever point it crashed at.
+	app.treeMtx.Lock()
+	err := p.batch.WriteSync()
+	app.treeMtx.Unlock()
 	if err != nil {
 		app.logger.Error("abci", "method", "Commit", "msg", "error writing batch", "err", err)
 		return nil, errors.New("error during commit")
 	}
-	return &abcitypes.CommitResponse{}, nil
+	crash.Here(crash.CommitAfterWrite)
+	app.pending = nil
+	app.state = p.state
+	app.resetCheckState()
+	app.retainHeight = retainHeight
+	app.maybeSnapshot(app.state.Height)
+	app.maybePrune(retainHeight)
+	return &abcitypes.CommitResponse{RetainHeight: retainHeight}, nil
 }
 
 func (app *KVStoreApplication) ListSnapshots(_ context.Context, snapshots *abcitypes.ListSnapshotsRequest) (*abcitypes.ListSnapshotsResponse, error) {
-	return &abcitypes.ListSnapshotsResponse{}, nil
+	list, err := app.snapshots.List()
+	if err != nil {
+		app.logger.Error("abci", "method", "ListSnapshots", "msg", "error listing snapshots", "err", err)
+		return nil, err
+	}
+	resp := &abcitypes.ListSnapshotsResponse{}
+	for _, s := range list {
+		abciSnapshot, err := s.ABCI()
+		if err != nil {
+			return nil, err
+		}
+		resp.Snapshots = append(resp.Snapshots, abciSnapshot)
+	}
+	return resp, nil
 }
 
-func (app *KVStoreApplication) OfferSnapshot(_ context.Context, snapshot *abcitypes.OfferSnapshotRequest) (*abcitypes.OfferSnapshotResponse, error) {
-	return &abcitypes.OfferSnapshotResponse{}, nil
+func (app *KVStoreApplication) OfferSnapshot(_ context.Context, offer *abcitypes.OfferSnapshotRequest) (*abcitypes.OfferSnapshotResponse, error) {
+	app.abortRestore()
+
+	restorer, err := snapshot.NewRestorer(offer.Snapshot)
+	if errors.Is(err, snapshot.ErrUnknownFormat) {
+		app.logger.Info("abci", "method", "OfferSnapshot", "msg", "rejecting snapshot format", "format", offer.Snapshot.Format)
+		return &abcitypes.OfferSnapshotResponse{Result: abcitypes.OFFER_SNAPSHOT_RESULT_REJECT_FORMAT}, nil
+	}
+	if err != nil {
+		app.logger.Info("abci", "method", "OfferSnapshot", "msg", "rejecting snapshot", "height", offer.Snapshot.Height, "err", err)
+		return &abcitypes.OfferSnapshotResponse{Result: abcitypes.OFFER_SNAPSHOT_RESULT_REJECT}, nil
+	}
+
+	batch := app.db.NewBatch()
+	if err := app.clearState(batch); err != nil {
+		app.logger.Error("abci", "method", "OfferSnapshot", "msg", "error clearing state", "err", err)
+		batch.Close()
+		return nil, err
+	}
+	app.restore = &restore{
+		restorer: restorer,
+		appHash:  offer.AppHash,
+		w: &stateWriter{
+			store:   app.store,
+			batch:   batch,
+			tree:    smt.NewTree(app.db, nil),
+			version: int64(offer.Snapshot.Height),
+		},
+	}
+	crash.SetHeight(int64(offer.Snapshot.Height))
+	app.logger.Info("abci", "method", "OfferSnapshot", "msg", "restoring snapshot", "height", offer.Snapshot.Height, "chunks", offer.Snapshot.Chunks)
+	return &abcitypes.OfferSnapshotResponse{Result: abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT}, nil
 }
 
 func (app *KVStoreApplication) LoadSnapshotChunk(_ context.Context, chunk *abcitypes.LoadSnapshotChunkRequest) (*abcitypes.LoadSnapshotChunkResponse, error) {
-	return &abcitypes.LoadSnapshotChunkResponse{}, nil
+	bz, err := app.snapshots.LoadChunk(chunk.Height, chunk.Format, chunk.Chunk)
+	if err != nil {
+		app.logger.Error("abci", "method", "LoadSnapshotChunk", "msg", "error loading chunk", "height", chunk.Height, "chunk", chunk.Chunk, "err", err)
+		return nil, err
+	}
+	if fault := app.cfg.SnapshotFault; bz != nil && fault != snapshot.FaultNone {
+		app.logger.Info("abci", "method", "LoadSnapshotChunk", "msg", "serving faulty chunk", "height", chunk.Height, "chunk", chunk.Chunk, "fault", fault)
+		bz = fault.Chunk(bz)
+	}
+	return &abcitypes.LoadSnapshotChunkResponse{Chunk: bz}, nil
 }
 
 func (app *KVStoreApplication) ApplySnapshotChunk(_ context.Context, chunk *abcitypes.ApplySnapshotChunkRequest) (*abcitypes.ApplySnapshotChunkResponse, error) {
+	r := app.restore
+	if r == nil {
+		app.logger.Error("abci", "method", "ApplySnapshotChunk", "msg", "no snapshot is being restored")
+		return &abcitypes.ApplySnapshotChunkResponse{Result: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ABORT}, nil
+	}
+
+	done, err := r.restorer.Apply(chunk.Index, chunk.Chunk, r.w.Set)
+	if errors.Is(err, snapshot.ErrChunkHash) {
+		app.logger.Info("abci", "method", "ApplySnapshotChunk", "msg", "refetching chunk", "chunk", chunk.Index, "sender", chunk.Sender, "err", err)
+		return &abcitypes.ApplySnapshotChunkResponse{
+			Result:        abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_RETRY,
+			RefetchChunks: []uint32{chunk.Index},
+			RejectSenders: []string{chunk.Sender},
+		}, nil
+	}
+	if err != nil {
+		app.logger.Error("abci", "method", "ApplySnapshotChunk", "msg", "rejecting snapshot", "chunk", chunk.Index, "err", err)
+		app.abortRestore()
+		return &abcitypes.ApplySnapshotChunkResponse{Result: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_REJECT_SNAPSHOT}, nil
+	}
+	if !done {
+		crash.Here(crash.RestoreChunk)
+		return &abcitypes.ApplySnapshotChunkResponse{Result: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT}, nil
+	}
+
+	appHash, err := r.w.finish()
+	if err != nil {
+		return nil, err
+	}
+	state := appState{Height: r.w.version, AppHash: appHash}
+	if !bytes.Equal(state.AppHash, r.appHash) {
+		app.logger.Error("abci", "method", "ApplySnapshotChunk", "msg", "restored app hash does not match",
+			"height", state.Height, "app_hash", fmt.Sprintf("%X", state.AppHash), "expected", fmt.Sprintf("%X", r.appHash))
+		app.abortRestore()
+		return &abcitypes.ApplySnapshotChunkResponse{Result: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ABORT}, nil
+	}
+	if err := state.save(r.w.batch); err != nil {
+		return nil, err
+	}
+	crash.Here(crash.RestoreBeforeWrite)
+	if err := r.w.batch.WriteSync(); err != nil {
+		app.logger.Error("abci", "method", "ApplySnapshotChunk", "msg", "error writing restored state", "err", err)
+		return nil, err
+	}
+	app.state = state
+	app.restore = nil
+	if err := app.loadGenesisConfig(); err != nil {
+		return nil, err
+	}
+	app.logger.Info("abci", "method", "ApplySnapshotChunk", "msg", "snapshot restored", "height", state.Height, "app_hash", fmt.Sprintf("%X", state.AppHash))
 	return &abcitypes.ApplySnapshotChunkResponse{Result: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT}, nil
 }
 
 func (app *KVStoreApplication) ExtendVote(_ context.Context, extend *abcitypes.ExtendVoteRequest) (*abcitypes.ExtendVoteResponse, error) {
-	return &abcitypes.ExtendVoteResponse{}, nil
+	ext, err := app.newVoteExtension(extend.Height)
+	if err == nil {
+		ext, err = app.voteExtensionFaults.Load().extension(ext)
+	}
+	if err != nil {
+		app.logger.Error("abci", "method", "ExtendVote", "msg", "error encoding vote extension", "err", err)
+		return nil, err
+	}
+	return &abcitypes.ExtendVoteResponse{VoteExtension: ext}, nil
 }
 
 func (app *KVStoreApplication) VerifyVoteExtension(_ context.Context, verify *abcitypes.VerifyVoteExtensionRequest) (*abcitypes.VerifyVoteExtensionResponse, error) {
-	return &abcitypes.VerifyVoteExtensionResponse{}, nil
+	if reason := app.voteExtensionFaults.Load().rejection(verify.ValidatorAddress, verify.Height); reason != "" {
+		app.logger.Info("abci", "method", "VerifyVoteExtension", "msg", reason)
+		return &abcitypes.VerifyVoteExtensionResponse{Status: abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT}, nil
+	}
+	if err := app.verifyVoteExtension(verify.VoteExtension, verify.Height); err != nil {
+		app.logger.Info("abci", "method", "VerifyVoteExtension", "msg", "rejecting vote extension", "height", verify.Height,
+			"validator", fmt.Sprintf("%X", verify.ValidatorAddress), "err", err)
+		return &abcitypes.VerifyVoteExtensionResponse{Status: abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT}, nil
+	}
+	return &abcitypes.VerifyVoteExtensionResponse{Status: abcitypes.VERIFY_VOTE_EXTENSION_STATUS_ACCEPT}, nil
 }
 
-func (app *KVStoreApplication) isValid(tx []byte) uint32 {
+// isValid checks the format of a transaction. It returns its code and, if it is not valid, the
+// reason.
+func (app *KVStoreApplication) isValid(tx []byte) (uint32, error) {
+	return app.isValidIn(tx, nil)
+}
+
+// isValidIn checks the format of a transaction held by the given wrappers, outermost first. A
+// wrapper appears at most once, and a signed transaction is the outermost one, so that its
+// signature covers the fee and the lane of the transaction.
+func (app *KVStoreApplication) isValidIn(tx []byte, wrappers []string) (uint32, error) {
+	if wrapper := txWrapper(tx); wrapper != "" {
+		if slices.Contains(wrappers, wrapper) {
+			return codeTypeInvalidTxFormat, fmt.Errorf("nested %s transaction", wrapper)
+		}
+		if wrapper == "signed" && len(wrappers) > 0 {
+			return codeTypeInvalidTxFormat, fmt.Errorf("signed transaction in a %s transaction", wrappers[len(wrappers)-1])
+		}
+		wrappers = append(wrappers, wrapper)
+	}
+	if isLaneTx(tx) {
+		ltx, err := parseLaneTx(tx)
+		if err != nil {
+			return codeTypeInvalidTxFormat, err
+		}
+		return app.isValidIn(ltx.tx, wrappers)
+	}
+	if isFeeTx(tx) {
+		ftx, err := parseFeeTx(tx)
+		if err != nil {
+			return codeTypeInvalidTxFormat, err
+		}
+		return app.isValidIn(ftx.tx, wrappers)
+	}
+	if isSignedTx(tx) {
+		stx, err := parseSignedTx(tx)
+		if err != nil {
+			return codeTypeInvalidSignature, err
+		}
+		if err := stx.verify(app.chainID); err != nil {
+			return codeTypeInvalidSignature, err
+		}
+		return app.isValidIn(stx.tx, wrappers)
+	}
+	if isValidatorTx(tx) {
+		if _, err := parseValidatorTx(tx); err != nil {
+			return codeTypeInvalidValidatorTx, err
+		}
+		return codeTypeOK, nil
+	}
+	if isParamsTx(tx) {
+		if _, err := parseParamsTx(tx); err != nil {
+			return codeTypeInvalidParamsTx, err
+		}
+		return codeTypeOK, nil
+	}
+	if isOracleTx(tx) {
+		if len(wrappers) > 0 {
+			return codeTypeInvalidOracleTx, fmt.Errorf("oracle transaction in a %s transaction", wrappers[len(wrappers)-1])
+		}
+		if _, err := parseOracleTx(tx); err != nil {
+			return codeTypeInvalidOracleTx, err
+		}
+		return codeTypeOK, nil
+	}
+
 	// check format
-	parts := bytes.Split(tx, []byte("="))
-	if len(parts) != 2 {
-		return 1
+	ops, err := parseOps(tx)
+	if err != nil {
+		return codeTypeInvalidTxFormat, err
+	}
+	for _, o := range ops {
+		if bytes.HasPrefix(o.key, reservedPrefix) {
+			return codeTypeReservedKey, fmt.Errorf("key %q is reserved", o.key)
+		}
+		if app.cfg.MaxKeySize > 0 && len(o.key) > app.cfg.MaxKeySize {
+			return codeTypeInvalidTxFormat, fmt.Errorf("key of %d bytes exceeds the maximum of %d", len(o.key), app.cfg.MaxKeySize)
+		}
+		if app.cfg.MaxValueSize > 0 && len(o.value) > app.cfg.MaxValueSize {
+			return codeTypeInvalidTxFormat, fmt.Errorf("value of %d bytes exceeds the maximum of %d", len(o.value), app.cfg.MaxValueSize)
+		}
 	}
-	return 0
+	return codeTypeOK, nil
 }
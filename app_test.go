@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/merkle"
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+
+	db "kvstore/database"
+	"kvstore/smt"
+	"kvstore/snapshot"
+)
+
+const testChainID = "test-chain"
+
+func newTestApp(t *testing.T, cfg Config) *KVStoreApplication {
+	t.Helper()
+	pebble, err := db.NewPebbleDB("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pebble.Close() })
+	app, err := openTestApp(t, pebble, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// openTestApp opens the application stored in pebble, as a node does when it restarts.
+func openTestApp(t *testing.T, pebble *db.PebbleDB, cfg Config) (*KVStoreApplication, error) {
+	t.Helper()
+	snapshots, err := snapshot.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKVStoreApplication(pebble, snapshots, cfg, cmtlog.NewNopLogger())
+}
+
+func initChain(t *testing.T, app *KVStoreApplication, appState string, validators ...abcitypes.ValidatorUpdate) {
+	t.Helper()
+	_, err := app.InitChain(context.Background(), &abcitypes.InitChainRequest{
+		ChainId:       testChainID,
+		Validators:    validators,
+		AppStateBytes: []byte(appState),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func finalizeBlock(t *testing.T, app *KVStoreApplication, height int64, txs ...string) *abcitypes.FinalizeBlockResponse {
+	t.Helper()
+	req := &abcitypes.FinalizeBlockRequest{Height: height}
+	for _, tx := range txs {
+		req.Txs = append(req.Txs, []byte(tx))
+	}
+	resp, err := app.FinalizeBlock(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// commitBlock finalizes and commits the block of txs at height, and returns the results of its
+// transactions.
+func commitBlock(t *testing.T, app *KVStoreApplication, height int64, txs ...string) []*abcitypes.ExecTxResult {
+	t.Helper()
+	resp := finalizeBlock(t, app, height, txs...)
+	if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	return resp.TxResults
+}
+
+// storeContents returns the key/value pairs of the store at version.
+func storeContents(t *testing.T, app *KVStoreApplication, version int64) map[string]string {
+	t.Helper()
+	itr, err := app.store.Iterator(nil, nil, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	kvs := map[string]string{}
+	for ; itr.Valid(); itr.Next() {
+		kvs[string(itr.Key())] = string(itr.Value())
+	}
+	if err := itr.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+// adminRequest sends a request to the admin server of app and returns the response.
+func adminRequest(t *testing.T, app *KVStoreApplication, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	adminHandler(app).ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// putFault changes a fault of app through the admin server.
+func putFault(t *testing.T, app *KVStoreApplication, path, body string) {
+	t.Helper()
+	if w := adminRequest(t, app, http.MethodPut, path, body); w.Code != http.StatusOK {
+		t.Fatalf("PUT %s: status %d: %s", path, w.Code, w.Body)
+	}
+}
+
+func query(t *testing.T, app *KVStoreApplication, req *abcitypes.QueryRequest) *abcitypes.QueryResponse {
+	t.Helper()
+	resp, err := app.Query(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestQueryProof(t *testing.T) {
+	app := newTestApp(t, DefaultConfig())
+	initChain(t, app, `{}`)
+	// appHashes are the app hashes returned by FinalizeBlock, by height.
+	appHashes := map[int64][]byte{}
+	for height, txs := range [][]string{{"a=1"}, {"b=2"}, {"a=3"}} {
+		resp := finalizeBlock(t, app, int64(height+1), txs...)
+		if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		appHashes[int64(height+1)] = resp.AppHash
+	}
+
+	testCases := []struct {
+		name   string
+		height int64 // the height of the query, the latest if 0
+		key    string
+		value  string // "" if the key does not exist
+	}{
+		{name: "existing key", key: "a", value: "3"},
+		{name: "missing key", key: "c"},
+		{name: "existing key at a past height", height: 1, key: "a", value: "1"},
+		{name: "key missing at a past height", height: 1, key: "b"},
+	}
+	prt := smt.ProofRuntime()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := query(t, app, &abcitypes.QueryRequest{Data: []byte(tc.key), Height: tc.height, Prove: true})
+			if resp.Code != codeTypeOK || string(resp.Value) != tc.value {
+				t.Fatalf("code %d, value %q, want %q", resp.Code, resp.Value, tc.value)
+			}
+			appHash := appHashes[resp.Height]
+			keyPath := merkle.KeyPath{}.AppendKey([]byte(tc.key), merkle.KeyEncodingURL).String()
+			if tc.value == "" {
+				if err := prt.VerifyAbsence(resp.ProofOps, appHash, keyPath); err != nil {
+					t.Fatalf("verifying absence: %v", err)
+				}
+				if err := prt.VerifyValue(resp.ProofOps, appHash, keyPath, []byte("x")); err == nil {
+					t.Fatal("proof of absence verifies a value")
+				}
+				return
+			}
+			if err := prt.VerifyValue(resp.ProofOps, appHash, keyPath, resp.Value); err != nil {
+				t.Fatalf("verifying value: %v", err)
+			}
+			if err := prt.VerifyValue(resp.ProofOps, appHash, keyPath, []byte("x")); err == nil {
+				t.Fatal("proof verifies another value")
+			}
+			if err := prt.VerifyValue(resp.ProofOps, appHashes[2], keyPath, resp.Value); err == nil {
+				t.Fatal("proof verifies against the app hash of another height")
+			}
+		})
+	}
+}
+
+func TestQueryHeights(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RetainBlocks = 3
+	app := newTestApp(t, cfg)
+	_, err := app.InitChain(context.Background(), &abcitypes.InitChainRequest{
+		ChainId:       testChainID,
+		InitialHeight: 2,
+		AppStateBytes: []byte(`{"kvs": {"a": "genesis"}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The genesis state is the latest one until the first block is committed.
+	if resp := query(t, app, &abcitypes.QueryRequest{Data: []byte("a")}); resp.Code != codeTypeOK || string(resp.Value) != "genesis" {
+		t.Fatalf("genesis query: code %d (%s), value %q", resp.Code, resp.Log, resp.Value)
+	}
+	// The block at height 6 retains the heights from 4 on, the heights below are pruned in the
+	// background. Pruning is skipped while the previous one runs, so each one is waited for.
+	for height := int64(2); height <= 6; height++ {
+		commitBlock(t, app, height, fmt.Sprintf("a=%d", height))
+		for deadline := time.Now().Add(10 * time.Second); app.pruning.Load(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("pruning at height %d not done", height)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if pruned := app.prunedHeight.Load(); pruned != 4 {
+		t.Fatalf("pruned height %d, want 4", pruned)
+	}
+
+	testCases := []struct {
+		name   string
+		path   string
+		height int64
+		code   uint32
+		value  string
+		log    string // a part of the log, if not ""
+	}{
+		{name: "latest height", value: "6"},
+		{name: "past height", height: 4, value: "4"},
+		{name: "previous height", height: 5, value: "5"},
+		{name: "future height", height: 7, code: codeTypeFutureHeight},
+		{name: "pruned height", height: 3, code: codeTypePrunedHeight, log: "not retained"},
+		{name: "pruned initial height", height: 2, code: codeTypePrunedHeight, log: "not retained"},
+		{name: "below the initial height", height: 1, code: codeTypePrunedHeight, log: "below the initial height"},
+		{name: "negative height", height: -1, code: codeTypePrunedHeight, log: "below the initial height"},
+		{name: "key path", path: "/key", height: 4, value: "4"},
+		{name: "unknown path", path: "/store", code: codeTypeUnknownPath},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := query(t, app, &abcitypes.QueryRequest{Path: tc.path, Data: []byte("a"), Height: tc.height})
+			if resp.Code != tc.code {
+				t.Fatalf("code %d (%s), want %d", resp.Code, resp.Log, tc.code)
+			}
+			if string(resp.Value) != tc.value {
+				t.Fatalf("value %q, want %q", resp.Value, tc.value)
+			}
+			if !strings.Contains(resp.Log, tc.log) {
+				t.Fatalf("log %q, want %q in it", resp.Log, tc.log)
+			}
+		})
+	}
+}
+
+func TestInfoAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	pebble, err := db.NewPebbleDB("test", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := openTestApp(t, pebble, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	initChain(t, app, `{}`)
+	var appHash []byte
+	for height := int64(1); height <= 3; height++ {
+		appHash = finalizeBlock(t, app, height, fmt.Sprintf("a=%d", height)).AppHash
+		if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The block finalized but not committed before the restart is not reported.
+	finalizeBlock(t, app, 4, "a=4")
+	if err := pebble.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pebble, err = db.NewPebbleDB("test", dir); err != nil {
+		t.Fatal(err)
+	}
+	defer pebble.Close()
+	restarted, err := openTestApp(t, pebble, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := restarted.Info(context.Background(), &abcitypes.InfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastBlockHeight != 3 {
+		t.Fatalf("last block height %d, want 3", info.LastBlockHeight)
+	}
+	if !bytes.Equal(info.LastBlockAppHash, appHash) {
+		t.Fatalf("last block app hash %X, want %X", info.LastBlockAppHash, appHash)
+	}
+}
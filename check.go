@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	db "kvstore/database"
+)
+
+// resetCheckState discards the check state, so that the following transactions are checked
+// against the committed state. The check state holds the writes of the transactions accepted by
+// CheckTx since the last commit, so that every transaction is checked against the state left by
+// the transactions before it in the mempool. CometBFT rechecks the transactions left in the
+// mempool after every commit, which rebuilds it from the new committed state.
+func (app *KVStoreApplication) resetCheckState() {
+	app.checkState = app.newCheckState()
+}
+
+// newCheckState returns a check state holding no writes on top of the committed state.
+func (app *KVStoreApplication) newCheckState() *opBatch {
+	return newOpBatch(func(key []byte) ([]byte, error) {
+		return app.store.Get(key, db.LatestVersion)
+	})
+}
+
+// checkTx checks a transaction against the check state s, and applies it to s if it is valid.
+// It returns the code of the transaction and, if it is not valid, the reason.
+func (app *KVStoreApplication) checkTx(s *opBatch, tx []byte) (uint32, error) {
+	if code, err := app.isValid(tx); code != codeTypeOK {
+		return code, err
+	}
+	switch {
+	case isFeeTx(tx):
+		ftx, _ := parseFeeTx(tx)
+		return app.checkTx(s, ftx.tx)
+	case isLaneTx(tx):
+		ltx, _ := parseLaneTx(tx)
+		return app.checkTx(s, ltx.tx)
+	case isSignedTx(tx):
+		return app.checkSignedTx(s, tx)
+	case isValidatorTx(tx):
+		return app.checkValidatorTx(tx)
+	case isParamsTx(tx):
+		return app.checkParamsTx(tx)
+	case isOracleTx(tx):
+		return codeTypeInvalidOracleTx, errOracleTx
+	}
+
+	ops, _ := parseOps(tx)
+	batch := newOpBatch(s.read)
+	for _, o := range ops {
+		_, err := batch.apply(o)
+		var opErr *opError
+		if errors.As(err, &opErr) {
+			return opErr.code, opErr
+		}
+		if err != nil {
+			app.logger.Error("abci", "method", "CheckTx", "msg", "error applying op", "err", err)
+			return codeTypeInternalError, errors.New("error applying op")
+		}
+	}
+	if err := batch.flush(s); err != nil {
+		return codeTypeInternalError, err
+	}
+	return codeTypeOK, nil
+}
+
+// checkSignedTx checks a signed transaction against the check state s. Nonces above the nonce of
+// the account are accepted, so that the following transactions of an account can enter the
+// mempool before the previous ones, but they are not applied to s until they are rechecked
+// without a gap.
+func (app *KVStoreApplication) checkSignedTx(s *opBatch, tx []byte) (uint32, error) {
+	stx, err := parseSignedTx(tx)
+	if err != nil {
+		return codeTypeInvalidSignature, err
+	}
+	addr := stx.pubKey.Address()
+	nonce, err := loadNonce(s.read, addr)
+	if err != nil {
+		app.logger.Error("abci", "method", "CheckTx", "msg", "error loading nonce", "err", err)
+		return codeTypeInternalError, errors.New("error loading nonce")
+	}
+	if stx.nonce < nonce {
+		return codeTypeInvalidNonce, fmt.Errorf("nonce %d was already used, the account nonce is %d", stx.nonce, nonce)
+	}
+
+	batch := newOpBatch(s.read)
+	if code, err := app.checkTx(batch, stx.tx); code != codeTypeOK || stx.nonce > nonce {
+		return code, err
+	}
+	if err := batch.Set(accountKey(addr), binary.BigEndian.AppendUint64(nil, nonce+1)); err != nil {
+		return codeTypeInternalError, err
+	}
+	if err := batch.flush(s); err != nil {
+		return codeTypeInternalError, err
+	}
+	return codeTypeOK, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestCheckState(t *testing.T) {
+	type step struct {
+		commit  []string // the block committed before the transaction is checked, if any
+		tx      string
+		recheck bool
+		code    uint32
+	}
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "transactions checked against the previous ones",
+			steps: []step{
+				{tx: "cas:k=1=2"},
+				{tx: "cas:k=2=3"},
+				{tx: "cas:k=1=5", code: codeTypeCompareFailed},
+				{tx: "inc:k=1"},
+				{tx: "cas:k=4=5"},
+			},
+		},
+		{
+			name: "failed transactions not applied",
+			steps: []step{
+				{tx: "multi:k=7;cas:missing=x=y", code: codeTypeCompareFailed},
+				{tx: "cas:k=1=2"},
+			},
+		},
+		{
+			name: "check state reset by commit",
+			steps: []step{
+				{tx: "cas:k=1=2"},
+				{commit: []string{"k=9"}, tx: "cas:k=9=10"},
+			},
+		},
+		{
+			name: "transactions evicted on recheck",
+			steps: []step{
+				{tx: "cas:k=1=2"},
+				{tx: "cas:k=2=3"},
+				{commit: []string{"k=9"}, tx: "cas:k=1=2", recheck: true, code: codeTypeCompareFailed},
+				{tx: "cas:k=2=3", recheck: true, code: codeTypeCompareFailed},
+				{tx: "cas:k=9=10"},
+			},
+		},
+		{
+			name: "transactions kept on recheck",
+			steps: []step{
+				{tx: "cas:k=1=2"},
+				{tx: "cas:k=2=3"},
+				{commit: []string{"other=1"}, tx: "cas:k=1=2", recheck: true},
+				{tx: "cas:k=2=3", recheck: true},
+				{tx: "cas:k=2=4", code: codeTypeCompareFailed},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, `{"kvs": {"k": "1"}}`)
+			height := int64(0)
+			for i, s := range tc.steps {
+				if s.commit != nil {
+					height++
+					commitBlock(t, app, height, s.commit...)
+				}
+				typ := abcitypes.CHECK_TX_TYPE_CHECK
+				if s.recheck {
+					typ = abcitypes.CHECK_TX_TYPE_RECHECK
+				}
+				resp, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(s.tx), Type: typ})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code != s.code {
+					t.Fatalf("step %d: code %d (%s), want %d", i, resp.Code, resp.Log, s.code)
+				}
+			}
+		})
+	}
+}
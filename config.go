@@ -0,0 +1,148 @@
+package main
+
+import (
+	"maps"
+	"slices"
+
+	"kvstore/snapshot"
+)
+
+// Config is the configuration of the application. It can be set by the genesis app_state, in
+// which case it overrides the configuration of every node.
+type Config struct {
+	// MaxKeySize is the maximum size in bytes of the keys written by transactions. Zero means
+	// no limit.
+	MaxKeySize int `json:"max_key_size"`
+
+	// MaxValueSize is the maximum size in bytes of the values written by transactions. Zero
+	// means no limit.
+	MaxValueSize int `json:"max_value_size"`
+
+	// SnapshotInterval is the number of heights between state sync snapshots. Zero disables
+	// snapshots.
+	SnapshotInterval uint64 `json:"snapshot_interval"`
+
+	// SnapshotKeepRecent is the number of most recent snapshots to keep.
+	SnapshotKeepRecent int `json:"snapshot_keep_recent"`
+
+	// SnapshotChunkSize is the maximum size of a snapshot chunk in bytes.
+	SnapshotChunkSize int `json:"snapshot_chunk_size"`
+
+	// SnapshotFormat is the format of the snapshots taken by this node. Nodes only restore
+	// snapshot.Format, any other value makes peers reject the snapshots of this node.
+	SnapshotFormat uint32 `json:"snapshot_format"`
+
+	// RetainBlocks is the number of most recent blocks this node keeps, the others are pruned
+	// by CometBFT and their state by the application. Zero keeps every block.
+	RetainBlocks int64 `json:"retain_blocks"`
+
+	// RetainFromSnapshot makes this node keep the blocks from the height of its latest
+	// snapshot, and every block until it takes one. With RetainBlocks, the lowest of the two
+	// retain heights applies.
+	RetainFromSnapshot bool `json:"retain_from_snapshot"`
+
+	// SnapshotFault makes this node take or serve faulty snapshots.
+	SnapshotFault snapshot.Fault `json:"snapshot_fault"`
+
+	// ProposalStrategies are the names of the strategies applied in order to the transactions of
+	// the proposals of this node, see proposalStrategies.
+	ProposalStrategies []string `json:"proposal_strategies"`
+
+	// RejectInvalidTxs makes this node reject the proposals holding transactions that fail
+	// CheckTx against the committed state with the transactions before them.
+	RejectInvalidTxs bool `json:"reject_invalid_txs"`
+
+	// MaxProposalTxs makes this node reject the proposals with more transactions. Zero means no
+	// limit.
+	MaxProposalTxs int `json:"max_proposal_txs"`
+
+	// MaxProposalBytes makes this node reject the proposals whose transactions have more bytes.
+	// Zero means no limit.
+	MaxProposalBytes int64 `json:"max_proposal_bytes"`
+
+	// RejectProbability is the probability that this node rejects a proposal at random.
+	RejectProbability float64 `json:"reject_probability"`
+
+	// RejectProposer makes this node reject the proposals of the validator with this hex address.
+	RejectProposer string `json:"reject_proposer"`
+
+	// Lanes are the mempool lanes transactions are assigned to, none by default.
+	Lanes []Lane `json:"lanes"`
+
+	// DefaultLane is the lane of the transactions assigned to no other lane. It must be one of
+	// Lanes if there are any.
+	DefaultLane string `json:"default_lane"`
+
+	// VoteExtensionFaults are the vote extension faults of this node when it starts, see
+	// VoteExtensionFaults.
+	VoteExtensionFaults VoteExtensionFaults `json:"vote_extension_faults"`
+
+	// NonDeterminism is the non-determinism mode of this node when it starts, see
+	// NonDeterminism.
+	NonDeterminism NonDeterminism `json:"non_determinism"`
+
+	// Latencies are the delays of the ABCI methods of this node when it starts, see Latencies.
+	Latencies Latencies `json:"latencies"`
+
+	// MethodFaults are the faults of the ABCI methods of this node when it starts, see
+	// MethodFaults.
+	MethodFaults MethodFaults `json:"method_faults"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		SnapshotInterval:   0,
+		SnapshotKeepRecent: 2,
+		SnapshotChunkSize:  10 << 20,
+		SnapshotFormat:     snapshot.Format,
+		SnapshotFault:      snapshot.FaultNone,
+	}
+}
+
+// validate checks the configuration, whether it comes from the command line, the genesis
+// app_state or both.
+func (cfg Config) validate() error {
+	if err := cfg.validateLanes(); err != nil {
+		return err
+	}
+	if err := cfg.validateSnapshots(); err != nil {
+		return err
+	}
+	if err := cfg.validateRetention(); err != nil {
+		return err
+	}
+	if err := validateProposalStrategies(cfg.ProposalStrategies); err != nil {
+		return err
+	}
+	if err := cfg.validateRejections(); err != nil {
+		return err
+	}
+	if err := cfg.VoteExtensionFaults.validate(); err != nil {
+		return err
+	}
+	if err := cfg.NonDeterminism.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Latencies.validate(); err != nil {
+		return err
+	}
+	return cfg.MethodFaults.validate()
+}
+
+// withGenesisConfig returns the configuration with the configuration of the genesis app_state
+// bz overlaid, if any, and checks the result. cfg is left unchanged.
+func (cfg Config) withGenesisConfig(bz []byte) (Config, error) {
+	if len(bz) != 0 {
+		cfg.ProposalStrategies = slices.Clone(cfg.ProposalStrategies)
+		cfg.Lanes = slices.Clone(cfg.Lanes)
+		cfg.Latencies = maps.Clone(cfg.Latencies)
+		cfg.MethodFaults = maps.Clone(cfg.MethodFaults)
+		if err := decodeConfig(bz, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cometbft/cometbft/crypto"
+)
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cfg   func(cfg *Config)
+		valid bool
+	}{
+		{name: "default", cfg: func(cfg *Config) {}, valid: true},
+		{name: "zero snapshot chunk size", cfg: func(cfg *Config) { cfg.SnapshotChunkSize = 0 }},
+		{name: "negative snapshot chunk size", cfg: func(cfg *Config) { cfg.SnapshotChunkSize = -1 }},
+		{name: "zero snapshots kept", cfg: func(cfg *Config) { cfg.SnapshotKeepRecent = 0 }},
+		{name: "negative snapshots kept", cfg: func(cfg *Config) { cfg.SnapshotKeepRecent = -1 }},
+		{name: "lanes", cfg: func(cfg *Config) { cfg.Lanes, cfg.DefaultLane = []Lane{{Name: "a"}, {Name: "b"}}, "b" }, valid: true},
+		{name: "duplicate lane", cfg: func(cfg *Config) { cfg.Lanes, cfg.DefaultLane = []Lane{{Name: "a"}, {Name: "a"}}, "a" }},
+		{name: "default lane not a lane", cfg: func(cfg *Config) { cfg.Lanes, cfg.DefaultLane = []Lane{{Name: "a"}}, "b" }},
+		{name: "default lane without lanes", cfg: func(cfg *Config) { cfg.DefaultLane = "a" }},
+		{name: "reject probability", cfg: func(cfg *Config) { cfg.RejectProbability = 1 }, valid: true},
+		{name: "reject probability above 1", cfg: func(cfg *Config) { cfg.RejectProbability = 7 }},
+		{name: "negative reject probability", cfg: func(cfg *Config) { cfg.RejectProbability = -0.5 }},
+		{name: "reject proposer", cfg: func(cfg *Config) { cfg.RejectProposer = strings.Repeat("aB", crypto.AddressSize) }, valid: true},
+		{name: "reject proposer not hex", cfg: func(cfg *Config) { cfg.RejectProposer = strings.Repeat("xy", crypto.AddressSize) }},
+		{name: "short reject proposer", cfg: func(cfg *Config) { cfg.RejectProposer = "abcd" }},
+		{name: "long reject proposer", cfg: func(cfg *Config) { cfg.RejectProposer = strings.Repeat("ab", crypto.AddressSize+1) }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			err := cfg.validate()
+			if tc.valid && err != nil {
+				t.Fatalf("expected a valid config, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an invalid config")
+			}
+		})
+	}
+}
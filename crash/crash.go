@@ -0,0 +1,220 @@
+// Package crash makes the process exit at named points of the code, to test how CometBFT
+// recovers from crashes of the application. A point is armed with the height it crashes at and
+// the number of times it is hit at that height before it crashes. The process exits with
+// os.Exit, so no deferred function runs and nothing is flushed or closed.
+package crash
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ExitCode is the exit code of the process when it crashes at a point.
+const ExitCode = 3
+
+// EnvVar is the environment variable arming points, with the comma-separated points of the form
+// taken by ParsePoint.
+const EnvVar = "KVSTORE_CRASH_POINTS"
+
+// Names of the crash points.
+const (
+	// FinalizeBlockEnd is hit after FinalizeBlock executed the block, before it returns.
+	FinalizeBlockEnd = "finalize-block-end"
+
+	// CommitStart is hit when Commit is called, after FinalizeBlock returned.
+	CommitStart = "commit-start"
+
+	// CommitBeforeWrite is hit in Commit before the block is written to the database.
+	CommitBeforeWrite = "commit-before-write"
+
+	// CommitAfterWrite is hit in Commit after the block is written to the database, before
+	// Commit returns.
+	CommitAfterWrite = "commit-after-write"
+
+	// RestoreChunk is hit in ApplySnapshotChunk after every applied chunk but the last one.
+	RestoreChunk = "restore-chunk"
+
+	// RestoreBeforeWrite is hit in ApplySnapshotChunk after the restored state is verified,
+	// before it is written to the database.
+	RestoreBeforeWrite = "restore-before-write"
+
+	// DBBeforeWrite is hit before every batch is written to the database, but the batches of
+	// background tasks such as pruning.
+	DBBeforeWrite = "db-before-write"
+
+	// DBAfterWrite is hit after every batch is written to the database, but the batches of
+	// background tasks such as pruning.
+	DBAfterWrite = "db-after-write"
+)
+
+var names = []string{
+	FinalizeBlockEnd, CommitStart, CommitBeforeWrite, CommitAfterWrite, RestoreChunk,
+	RestoreBeforeWrite, DBBeforeWrite, DBAfterWrite,
+}
+
+// Point is an armed crash point.
+type Point struct {
+	Name string `json:"name"`
+
+	// Height is the height the point crashes at, any height if it is zero.
+	Height int64 `json:"height"`
+
+	// Hit is the number of times the point is hit at Height before it crashes, at least 1.
+	Hit int `json:"hit"`
+}
+
+func (p Point) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Name, p.Height, p.Hit)
+}
+
+// ParsePoint parses a point of the form <name>[:<height>[:<hit>]].
+func ParsePoint(s string) (Point, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return Point{}, errors.New("expected <name>[:<height>[:<hit>]]")
+	}
+	p := Point{Name: parts[0], Hit: 1}
+	var err error
+	if len(parts) > 1 {
+		if p.Height, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return Point{}, fmt.Errorf("parsing height: %w", err)
+		}
+	}
+	if len(parts) > 2 {
+		if p.Hit, err = strconv.Atoi(parts[2]); err != nil {
+			return Point{}, fmt.Errorf("parsing hit: %w", err)
+		}
+	}
+	return p, p.Validate()
+}
+
+func (p Point) Validate() error {
+	if !slices.Contains(names, p.Name) {
+		return fmt.Errorf("unknown crash point %q, expected one of %v", p.Name, names)
+	}
+	if p.Height < 0 {
+		return fmt.Errorf("height %d is negative", p.Height)
+	}
+	if p.Hit < 1 {
+		return fmt.Errorf("hit %d is not positive", p.Hit)
+	}
+	return nil
+}
+
+// ParseEnv returns the points armed by EnvVar.
+func ParseEnv() ([]Point, error) {
+	var points []Point
+	for _, s := range strings.Split(os.Getenv(EnvVar), ",") {
+		if s == "" {
+			continue
+		}
+		p, err := ParsePoint(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvVar, err)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+var (
+	mtx       sync.Mutex
+	armed     []Point
+	hits      map[Point]int
+	firedPath string
+
+	// height is the height of the block being decided or restored.
+	height atomic.Int64
+
+	// exit exits the process, replaced by tests that hit the points.
+	exit = os.Exit
+)
+
+// Arm arms the points, but the ones that already crashed the process. They are recorded in the
+// file at path, so that the process does not crash again at the same point when it restarts and
+// replays the block it crashed at.
+func Arm(points []Point, path string) error {
+	fired := map[string]bool{}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fired[scanner.Text()] = true
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	armed = nil
+	hits = map[Point]int{}
+	firedPath = path
+	for _, p := range points {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if !fired[p.String()] {
+			armed = append(armed, p)
+		}
+	}
+	return nil
+}
+
+// Armed returns the armed points.
+func Armed() []Point {
+	mtx.Lock()
+	defer mtx.Unlock()
+	return slices.Clone(armed)
+}
+
+// SetHeight sets the height of the block being decided or restored, which armed points are
+// compared to.
+func SetHeight(h int64) {
+	height.Store(h)
+}
+
+// Here crashes the process if the point with the given name is armed at the current height and
+// was hit as many times as it crashes after.
+func Here(name string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	h := height.Load()
+	for _, p := range armed {
+		if p.Name != name || p.Height != 0 && p.Height != h {
+			continue
+		}
+		hits[p]++
+		if hits[p] < p.Hit {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "crash point %s hit at height %d, exiting\n", p, h)
+		if err := recordFired(p); err != nil {
+			fmt.Fprintf(os.Stderr, "error recording crash point %s: %v\n", p, err)
+		}
+		exit(ExitCode)
+	}
+}
+
+func recordFired(p Point) error {
+	f, err := os.OpenFile(firedPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, p); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,131 @@
+package crash
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// exited is the panic value of exit in tests, holding the exit code.
+type exited int
+
+// hit hits the point at the height, reporting whether the process exited.
+func hit(t *testing.T, name string, h int64) (crashed bool) {
+	t.Helper()
+	exit = func(code int) { panic(exited(code)) }
+	t.Cleanup(func() { exit = os.Exit })
+	defer func() {
+		if r := recover(); r != nil {
+			if r != exited(ExitCode) {
+				t.Fatalf("exited with %v, want %d", r, ExitCode)
+			}
+			crashed = true
+		}
+	}()
+	SetHeight(h)
+	Here(name)
+	return false
+}
+
+func TestParsePoint(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want Point
+		err  bool
+	}{
+		{s: "commit-start", want: Point{Name: CommitStart, Hit: 1}},
+		{s: "commit-start:5", want: Point{Name: CommitStart, Height: 5, Hit: 1}},
+		{s: "db-after-write:5:3", want: Point{Name: DBAfterWrite, Height: 5, Hit: 3}},
+		{s: "db-after-write:0:2", want: Point{Name: DBAfterWrite, Hit: 2}},
+		{s: "unknown", err: true},
+		{s: "commit-start:-1", err: true},
+		{s: "commit-start:1:0", err: true},
+		{s: "commit-start:x", err: true},
+		{s: "commit-start:1:1:1", err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			p, err := ParsePoint(tc.s)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tc.want {
+				t.Fatalf("parsed %v, want %v", p, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv(EnvVar, "commit-start:2,,restore-chunk:0:3")
+	points, err := ParseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Point{{Name: CommitStart, Height: 2, Hit: 1}, {Name: RestoreChunk, Hit: 3}}
+	if !slices.Equal(points, want) {
+		t.Fatalf("parsed %v, want %v", points, want)
+	}
+
+	t.Setenv(EnvVar, "commit-start,unknown")
+	if _, err := ParseEnv(); err == nil {
+		t.Fatal("expected an error for an unknown point")
+	}
+
+	t.Setenv(EnvVar, "")
+	if points, err := ParseEnv(); err != nil || len(points) != 0 {
+		t.Fatalf("parsed %v, %v without points", points, err)
+	}
+}
+
+func TestHere(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fired")
+	points := []Point{
+		{Name: CommitStart, Height: 3, Hit: 1},
+		{Name: CommitAfterWrite, Hit: 2},
+	}
+	if err := Arm(points, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A point armed at a height only crashes at that height.
+	if hit(t, CommitStart, 2) {
+		t.Fatal("crashed at height 2")
+	}
+	if hit(t, CommitBeforeWrite, 3) {
+		t.Fatal("crashed at a point that is not armed")
+	}
+	if !hit(t, CommitStart, 3) {
+		t.Fatal("did not crash at height 3")
+	}
+
+	// A point armed at any height crashes when it is hit as many times as it crashes after.
+	if hit(t, CommitAfterWrite, 1) {
+		t.Fatal("crashed at the first hit")
+	}
+	if !hit(t, CommitAfterWrite, 1) {
+		t.Fatal("did not crash at the second hit")
+	}
+
+	// The points that crashed are not armed again.
+	if err := Arm(append(points, Point{Name: RestoreChunk, Hit: 1}), path); err != nil {
+		t.Fatal(err)
+	}
+	if armed := Armed(); !slices.Equal(armed, []Point{{Name: RestoreChunk, Hit: 1}}) {
+		t.Fatalf("armed %v after restarting", armed)
+	}
+	if hit(t, CommitStart, 3) {
+		t.Fatal("crashed again at a point that already crashed")
+	}
+
+	if err := Arm([]Point{{Name: CommitStart, Hit: 0}}, path); err == nil {
+		t.Fatal("expected an error arming an invalid point")
+	}
+}
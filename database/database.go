@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cockroachdb/pebble"
+	"kvstore/crash"
 	"kvstore/utils"
 	"path/filepath"
 )
@@ -184,6 +185,15 @@ func (db *PebbleDB) NewBatch() Batch {
 	return newPebbleDBBatch(db)
 }
 
+// NewBackgroundBatch creates a batch for the writes of background tasks, such as pruning. Its
+// writes do not hit the DBBeforeWrite and DBAfterWrite crash points, so that the hits of these
+// points only count the writes of the ABCI methods and do not depend on goroutine timing.
+func (db *PebbleDB) NewBackgroundBatch() Batch {
+	b := newPebbleDBBatch(db)
+	b.background = true
+	return b
+}
+
 // Iterator implements DB.
 func (db *PebbleDB) Iterator(start, end []byte) (Iterator, error) {
 	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
@@ -224,6 +234,9 @@ var _ Batch = (*pebbleDBBatch)(nil)
 type pebbleDBBatch struct {
 	db    *PebbleDB
 	batch *pebble.Batch
+
+	// background batches do not hit crash points, see NewBackgroundBatch.
+	background bool
 }
 
 var _ Batch = (*pebbleDBBatch)(nil)
@@ -273,10 +286,12 @@ func (b *pebbleDBBatch) Write() error {
 	}
 
 	wopts := pebble.NoSync
+	b.crashPoint(crash.DBBeforeWrite)
 	err := b.batch.Commit(wopts)
 	if err != nil {
 		return err
 	}
+	b.crashPoint(crash.DBAfterWrite)
 	// Make sure batch cannot be used afterward. Callers should still call Close(), for errors.
 
 	return b.Close()
@@ -287,14 +302,22 @@ func (b *pebbleDBBatch) WriteSync() error {
 	if b.batch == nil {
 		return errBatchClosed
 	}
+	b.crashPoint(crash.DBBeforeWrite)
 	err := b.batch.Commit(pebble.Sync)
 	if err != nil {
 		return err
 	}
+	b.crashPoint(crash.DBAfterWrite)
 	// Make sure batch cannot be used afterward. Callers should still call Close(), for errors.
 	return b.Close()
 }
 
+func (b *pebbleDBBatch) crashPoint(name string) {
+	if !b.background {
+		crash.Here(name)
+	}
+}
+
 // Close implements Batch.
 func (b *pebbleDBBatch) Close() error {
 	if b.batch != nil {
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+
+	"kvstore/utils"
+)
+
+// IndexedBatch is a batch whose reads see its pending writes merged with the committed state of
+// the database, so that a block can read its own writes before it is committed.
+type IndexedBatch struct {
+	pebbleDBBatch
+}
+
+var (
+	_ Batch  = (*IndexedBatch)(nil)
+	_ Reader = (*IndexedBatch)(nil)
+)
+
+// NewIndexedBatch creates an indexed batch. The caller must call Batch.Close.
+func (db *PebbleDB) NewIndexedBatch() *IndexedBatch {
+	return &IndexedBatch{pebbleDBBatch{db: db, batch: db.db.NewIndexedBatch()}}
+}
+
+// Get implements Reader.
+func (b *IndexedBatch) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+	if b.batch == nil {
+		return nil, errBatchClosed
+	}
+
+	res, closer, err := b.batch.Get(key)
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+
+	return utils.Copy(res), nil
+}
+
+// Has implements Reader.
+func (b *IndexedBatch) Has(key []byte) (bool, error) {
+	value, err := b.Get(key)
+	if err != nil {
+		return false, err
+	}
+	return value != nil, nil
+}
+
+// Iterator implements Reader. The iterator does not see the writes made after its creation.
+func (b *IndexedBatch) Iterator(start, end []byte) (Iterator, error) {
+	itr, err := b.newIter(start, end)
+	if err != nil {
+		return nil, err
+	}
+	itr.First()
+	return newPebbleDBIterator(itr, start, end, false), nil
+}
+
+// ReverseIterator implements Reader. The iterator does not see the writes made after its
+// creation.
+func (b *IndexedBatch) ReverseIterator(start, end []byte) (Iterator, error) {
+	itr, err := b.newIter(start, end)
+	if err != nil {
+		return nil, err
+	}
+	itr.Last()
+	return newPebbleDBIterator(itr, start, end, true), nil
+}
+
+func (b *IndexedBatch) newIter(start, end []byte) (*pebble.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	if b.batch == nil {
+		return nil, errBatchClosed
+	}
+	return b.batch.NewIter(&pebble.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+}
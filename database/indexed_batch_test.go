@@ -0,0 +1,122 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIndexedBatchOverlay(t *testing.T) {
+	db := newTestDB(t)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Set([]byte(key), []byte("db-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := db.NewIndexedBatch()
+	defer batch.Close()
+	for _, key := range []string{"b", "e"} {
+		if err := batch.Set([]byte(key), []byte("batch-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"c", "e", "missing"} {
+		if err := batch.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Set([]byte("f"), []byte("batch-f")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		key  string
+		want string // empty if the key does not exist
+	}{
+		{key: "a", want: "db-a"},    // committed
+		{key: "b", want: "batch-b"}, // overwritten by the batch
+		{key: "c"},                  // deleted by the batch
+		{key: "d", want: "db-d"},    // committed
+		{key: "e"},                  // set then deleted by the batch
+		{key: "f", want: "batch-f"}, // set by the batch
+		{key: "missing"},            // deleted by the batch, never set
+		{key: "other"},              // never written
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			value, err := batch.Get([]byte(tc.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" && value != nil {
+				t.Fatalf("Get = %q, want nil", value)
+			}
+			if tc.want != "" && string(value) != tc.want {
+				t.Fatalf("Get = %q, want %q", value, tc.want)
+			}
+			has, err := batch.Has([]byte(tc.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has != (tc.want != "") {
+				t.Fatalf("Has = %v, want %v", has, tc.want != "")
+			}
+		})
+	}
+
+	iterate := func(reverse bool, start, end []byte) string {
+		t.Helper()
+		var itr Iterator
+		var err error
+		if reverse {
+			itr, err = batch.ReverseIterator(start, end)
+		} else {
+			itr, err = batch.Iterator(start, end)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer itr.Close()
+		var out []string
+		for ; itr.Valid(); itr.Next() {
+			out = append(out, string(itr.Key())+"="+string(itr.Value()))
+		}
+		if err := itr.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(out)
+	}
+	if got, want := iterate(false, nil, nil), "[a=db-a b=batch-b d=db-d f=batch-f]"; got != want {
+		t.Fatalf("iterated %s, want %s", got, want)
+	}
+	if got, want := iterate(true, []byte("b"), []byte("f")), "[d=db-d b=batch-b]"; got != want {
+		t.Fatalf("reverse iterated %s, want %s", got, want)
+	}
+
+	// The database does not see the writes of the batch until it is written.
+	if value, err := db.Get([]byte("c")); err != nil || string(value) != "db-c" {
+		t.Fatalf("database Get = %q, %v before the batch is written", value, err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("c")); err != nil || value != nil {
+		t.Fatalf("database Get = %q, %v after the batch is written", value, err)
+	}
+	if value, err := db.Get([]byte("b")); err != nil || string(value) != "batch-b" {
+		t.Fatalf("database Get = %q, %v after the batch is written", value, err)
+	}
+}
+
+func TestIndexedBatchClosed(t *testing.T) {
+	db := newTestDB(t)
+	batch := db.NewIndexedBatch()
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Get([]byte("a")); err == nil {
+		t.Fatal("expected an error reading a closed batch")
+	}
+	if _, err := batch.Iterator(nil, nil); err == nil {
+		t.Fatal("expected an error iterating a closed batch")
+	}
+}
@@ -73,6 +73,25 @@ type DB interface {
 	Compact(start, end []byte) error
 }
 
+// Reader is the read side of a DB. It is implemented by DB and by IndexedBatch, so that reads can
+// include the writes of a batch that is not written yet.
+type Reader interface {
+	// Get fetches the value of the given key, or nil if it does not exist.
+	// CONTRACT: key, value readonly []byte
+	Get([]byte) ([]byte, error)
+
+	// Has checks if a key exists.
+	// CONTRACT: key, value readonly []byte
+	Has(key []byte) (bool, error)
+
+	// Iterator returns an iterator over a domain of keys, in ascending order, see DB.Iterator.
+	Iterator(start, end []byte) (Iterator, error)
+
+	// ReverseIterator returns an iterator over a domain of keys, in descending order, see
+	// DB.ReverseIterator.
+	ReverseIterator(start, end []byte) (Iterator, error)
+}
+
 // Batch represents a group of writes. They may or may not be written atomically depending on the
 // backend. Callers must call Close on the batch when done.
 //
@@ -0,0 +1,427 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	tombstone   byte = 0
+	liveValue   byte = 1
+	versionSize      = 8
+)
+
+var (
+	// keyTerminator ends the escaped key in a versioned key. Zero bytes within keys are escaped
+	// as {0, 0xFF}, so the terminator sorts before any longer key sharing the same prefix.
+	keyTerminator = []byte{0, 1}
+	keyEnd        = []byte{0, 2}
+
+	errInvalidVersionedKey = errors.New("invalid versioned key")
+)
+
+// LatestVersion can be passed to the read methods of VersionedDB to read the latest version.
+const LatestVersion int64 = math.MaxInt64
+
+// VersionedDB is a multi-version key/value store on top of a DB. Every write is tagged with the
+// version (block height) it belongs to, and reads at a version see the latest write of each key
+// at or below it. Deletes are recorded as tombstones so that earlier versions stay readable.
+//
+// All keys are stored under prefix as prefix | escaped key | terminator | inverted version, so the
+// versions of a key are adjacent and sorted from newest to oldest. Writes go through a Batch, the
+// caller decides when to write it.
+//
+// Every write is also recorded in a change index under changesPrefix, as changesPrefix | version |
+// key, so that Prune only visits the keys written since the last pruning. changesPrefix must not
+// share keys with prefix. The index costs an entry per write until Prune deletes it, so it can be
+// disabled with IndexChanges when the store is never pruned.
+type VersionedDB struct {
+	db           Reader
+	prefix       []byte
+	changes      []byte
+	indexChanges bool
+}
+
+func NewVersionedDB(db Reader, prefix, changesPrefix []byte) *VersionedDB {
+	return &VersionedDB{db: db, prefix: prefix, changes: changesPrefix, indexChanges: true}
+}
+
+// WithReader returns a VersionedDB with the same prefix that reads from r, such as an
+// IndexedBatch holding writes that are not written yet.
+func (v *VersionedDB) WithReader(r Reader) *VersionedDB {
+	return &VersionedDB{db: r, prefix: v.prefix, changes: v.changes, indexChanges: v.indexChanges}
+}
+
+// IndexChanges returns a VersionedDB like v that records its writes in the change index only if
+// enabled. Prune does not visit the keys written while the index is disabled, their versions are
+// only pruned once the key is written again with the index enabled.
+func (v *VersionedDB) IndexChanges(enabled bool) *VersionedDB {
+	return &VersionedDB{db: v.db, prefix: v.prefix, changes: v.changes, indexChanges: enabled}
+}
+
+// Get returns the value of key at version, or nil if it does not exist at that version.
+func (v *VersionedDB) Get(key []byte, version int64) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+	itr, err := v.db.Iterator(v.encodeKey(key, version), v.keyUpperBound(key))
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	if !itr.Valid() {
+		return nil, itr.Error()
+	}
+	value := itr.Value()
+	if value[0] == tombstone {
+		return nil, nil
+	}
+	return value[1:], nil
+}
+
+// Has checks if key exists at version.
+func (v *VersionedDB) Has(key []byte, version int64) (bool, error) {
+	value, err := v.Get(key, version)
+	if err != nil {
+		return false, err
+	}
+	return value != nil, nil
+}
+
+// Set adds the write of key at version to the batch.
+func (v *VersionedDB) Set(batch Batch, key, value []byte, version int64) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if err := v.indexChange(batch, key, version); err != nil {
+		return err
+	}
+	return batch.Set(v.encodeKey(key, version), append([]byte{liveValue}, value...))
+}
+
+// Delete adds the deletion of key at version to the batch.
+func (v *VersionedDB) Delete(batch Batch, key []byte, version int64) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if err := v.indexChange(batch, key, version); err != nil {
+		return err
+	}
+	return batch.Set(v.encodeKey(key, version), []byte{tombstone})
+}
+
+// indexChange adds the change index entry of the write of key at version to the batch, if the
+// index is enabled.
+func (v *VersionedDB) indexChange(batch Batch, key []byte, version int64) error {
+	if !v.indexChanges {
+		return nil
+	}
+	return batch.Set(v.changeKey(version, key), []byte{})
+}
+
+// Iterator returns an iterator over the keys in [start, end) as they were at version, in
+// ascending order. As for DB.Iterator, nil start and end iterate from the first and to the
+// last key.
+func (v *VersionedDB) Iterator(start, end []byte, version int64) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	lower := v.prefix
+	if start != nil {
+		lower = append(append([]byte{}, v.prefix...), escapeKey(start)...)
+	}
+	upper := prefixEnd(v.prefix)
+	if end != nil {
+		upper = append(append([]byte{}, v.prefix...), escapeKey(end)...)
+	}
+	source, err := v.db.Iterator(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	itr := &versionedIterator{
+		source:  source,
+		prefix:  v.prefix,
+		version: version,
+		start:   start,
+		end:     end,
+	}
+	itr.advance()
+	return itr, nil
+}
+
+// PrefixIterator returns an iterator over the keys starting with prefix as they were at version.
+func (v *VersionedDB) PrefixIterator(prefix []byte, version int64) (Iterator, error) {
+	return v.Iterator(prefix, prefixEnd(prefix), version)
+}
+
+// Prune deletes the versions that no read at version or any later version can see: for every
+// key written at or below version since the last pruning, all its versions older than the latest
+// one at or below version, and that one too if it is a tombstone. The keys are found in the change
+// index, so pruning only visits the keys written since the last pruning.
+//
+// The deletes are written in batches created by newBatch of about batchSize deletes, each holding
+// all the deleted versions of its keys, so that reads never see a partially pruned key. progress
+// is called with the number of versions deleted so far after every batch. Prune returns the
+// number of deleted versions.
+func (v *VersionedDB) Prune(newBatch func() Batch, version int64, batchSize int, progress func(deleted int)) (int, error) {
+	itr, err := v.db.Iterator(v.changes, v.changeKey(version+1, nil))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	batch := newBatch()
+	defer func() { batch.Close() }()
+	deleted, versions, ops := 0, 0, 0
+	pruned := map[string]bool{}
+	for ; itr.Valid(); itr.Next() {
+		change := bytes.Clone(itr.Key())
+		key := change[len(v.changes)+versionSize:]
+		if !pruned[string(key)] {
+			pruned[string(key)] = true
+			n, err := v.pruneKey(batch, key, version)
+			if err != nil {
+				return deleted, err
+			}
+			versions += n
+			ops += n
+		}
+		if err := batch.Delete(change); err != nil {
+			return deleted, err
+		}
+		ops++
+		if ops >= batchSize {
+			if err := batch.Write(); err != nil {
+				return deleted, err
+			}
+			batch = newBatch()
+			deleted += versions
+			versions, ops = 0, 0
+			progress(deleted)
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return deleted, err
+	}
+	if ops > 0 {
+		if err := batch.Write(); err != nil {
+			return deleted, err
+		}
+		deleted += versions
+		progress(deleted)
+	}
+	return deleted, nil
+}
+
+// Clear adds to the batch the deletes of every version of every key, and of the change index.
+func (v *VersionedDB) Clear(batch Batch) error {
+	if err := DeletePrefix(v.db, batch, v.prefix); err != nil {
+		return err
+	}
+	return DeletePrefix(v.db, batch, v.changes)
+}
+
+// pruneKey adds to the batch the deletes of the versions of key that no read at version or any
+// later version can see, and returns how many there are.
+func (v *VersionedDB) pruneKey(batch Batch, key []byte, version int64) (int, error) {
+	itr, err := v.db.Iterator(v.encodeKey(key, version), v.keyUpperBound(key))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+	deleted := 0
+	for kept := false; itr.Valid(); itr.Next() {
+		if !kept {
+			kept = true
+			if itr.Value()[0] != tombstone {
+				continue
+			}
+		}
+		if err := batch.Delete(bytes.Clone(itr.Key())); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+	return deleted, itr.Error()
+}
+
+func (v *VersionedDB) encodeKey(key []byte, version int64) []byte {
+	out := append(append([]byte{}, v.prefix...), escapeKey(key)...)
+	out = append(out, keyTerminator...)
+	return binary.BigEndian.AppendUint64(out, ^uint64(version))
+}
+
+func (v *VersionedDB) changeKey(version int64, key []byte) []byte {
+	out := binary.BigEndian.AppendUint64(append([]byte{}, v.changes...), uint64(version))
+	return append(out, key...)
+}
+
+func (v *VersionedDB) keyUpperBound(key []byte) []byte {
+	out := append(append([]byte{}, v.prefix...), escapeKey(key)...)
+	return append(out, keyEnd...)
+}
+
+func decodeVersionedKey(prefix, raw []byte) (key []byte, version int64, err error) {
+	if !bytes.HasPrefix(raw, prefix) || len(raw) < len(prefix)+len(keyTerminator)+versionSize {
+		return nil, 0, errInvalidVersionedKey
+	}
+	escaped := raw[len(prefix) : len(raw)-versionSize]
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != 0 {
+			key = append(key, escaped[i])
+			continue
+		}
+		if i+1 >= len(escaped) {
+			return nil, 0, errInvalidVersionedKey
+		}
+		switch escaped[i+1] {
+		case 0xFF:
+			key = append(key, 0)
+			i++
+		case keyTerminator[1]:
+			if i+2 != len(escaped) {
+				return nil, 0, errInvalidVersionedKey
+			}
+			return key, int64(^binary.BigEndian.Uint64(raw[len(raw)-versionSize:])), nil
+		default:
+			return nil, 0, errInvalidVersionedKey
+		}
+	}
+	return nil, 0, errInvalidVersionedKey
+}
+
+func escapeKey(key []byte) []byte {
+	out := make([]byte, 0, len(key))
+	for _, b := range key {
+		if b == 0 {
+			out = append(out, 0, 0xFF)
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// prefixEnd returns the smallest key greater than all keys starting with prefix, or nil if
+// there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// DeletePrefix adds to the batch the deletes of the keys of r starting with prefix.
+func DeletePrefix(r Reader, batch Batch, prefix []byte) error {
+	itr, err := r.Iterator(prefix, prefixEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if err := batch.Delete(bytes.Clone(itr.Key())); err != nil {
+			return err
+		}
+	}
+	return itr.Error()
+}
+
+type versionedIterator struct {
+	source     Iterator
+	prefix     []byte
+	version    int64
+	start, end []byte
+	key, value []byte
+	err        error
+}
+
+var _ Iterator = (*versionedIterator)(nil)
+
+// advance moves to the next key that has a live value at the iterator version, skipping newer
+// and older versions and tombstones.
+func (itr *versionedIterator) advance() {
+	itr.key, itr.value = nil, nil
+	for itr.source.Valid() {
+		key, version, err := decodeVersionedKey(itr.prefix, itr.source.Key())
+		if err != nil {
+			itr.err = err
+			return
+		}
+		if version > itr.version {
+			itr.source.Next()
+			continue
+		}
+		value := itr.source.Value()
+		for itr.source.Next(); itr.source.Valid(); itr.source.Next() {
+			next, _, err := decodeVersionedKey(itr.prefix, itr.source.Key())
+			if err != nil {
+				itr.err = err
+				return
+			}
+			if !bytes.Equal(next, key) {
+				break
+			}
+		}
+		if value[0] == tombstone {
+			continue
+		}
+		itr.key, itr.value = key, value[1:]
+		return
+	}
+}
+
+// Domain implements Iterator.
+func (itr *versionedIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements Iterator.
+func (itr *versionedIterator) Valid() bool {
+	return itr.err == nil && itr.key != nil
+}
+
+// Next implements Iterator.
+func (itr *versionedIterator) Next() {
+	itr.assertIsValid()
+	itr.advance()
+}
+
+// Key implements Iterator.
+func (itr *versionedIterator) Key() []byte {
+	itr.assertIsValid()
+	return itr.key
+}
+
+// Value implements Iterator.
+func (itr *versionedIterator) Value() []byte {
+	itr.assertIsValid()
+	return itr.value
+}
+
+// Error implements Iterator.
+func (itr *versionedIterator) Error() error {
+	if itr.err != nil {
+		return itr.err
+	}
+	return itr.source.Error()
+}
+
+// Close implements Iterator.
+func (itr *versionedIterator) Close() error {
+	return itr.source.Close()
+}
+
+func (itr *versionedIterator) assertIsValid() {
+	if !itr.Valid() {
+		panic("iterator is invalid")
+	}
+}
@@ -0,0 +1,304 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *PebbleDB {
+	t.Helper()
+	db, err := NewPebbleDB("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type write struct {
+	version    int64
+	key, value string // an empty value deletes the key
+}
+
+// history writes keys containing 0x00 and 0xFF, overwritten and deleted at several versions.
+var history = []write{
+	{1, "a", "a1"},
+	{1, "b", "b1"},
+	{1, "x\x00", "x0"},
+	{2, "a", "a2"},
+	{2, "c", "c2"},
+	{3, "b", ""},
+	{3, "x", "x3"},
+	{3, "x\x00\xff", "x0ff"},
+	{3, "\xff", "ff"},
+	{4, "a", ""},
+	{4, "x\xff", "xff"},
+	{5, "a", "a5"},
+	{5, "x\x00", ""},
+}
+
+const historyVersions = 5
+
+func writeHistory(t *testing.T, db *PebbleDB, v *VersionedDB, writes []write) {
+	t.Helper()
+	for version := int64(1); version <= historyVersions; version++ {
+		batch := db.NewBatch()
+		for _, w := range writes {
+			if w.version != version {
+				continue
+			}
+			var err error
+			if w.value == "" {
+				err = v.Delete(batch, []byte(w.key), w.version)
+			} else {
+				err = v.Set(batch, []byte(w.key), []byte(w.value), w.version)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+		batch.Close()
+	}
+}
+
+// stateAt returns the keys and values of writes at version, by replaying them.
+func stateAt(writes []write, version int64) map[string]string {
+	state := map[string]string{}
+	for _, w := range writes {
+		if w.version > version {
+			continue
+		}
+		if w.value == "" {
+			delete(state, w.key)
+		} else {
+			state[w.key] = w.value
+		}
+	}
+	return state
+}
+
+// checkVersion checks that Get and Iterator at version return the state of history at version.
+func checkVersion(t *testing.T, v *VersionedDB, version int64) {
+	t.Helper()
+	state := stateAt(history, version)
+	for _, w := range history {
+		got, err := v.Get([]byte(w.key), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := state[w.key]
+		if !ok && got != nil {
+			t.Errorf("version %d: Get(%q) = %q, want nil", version, w.key, got)
+		}
+		if ok && string(got) != want {
+			t.Errorf("version %d: Get(%q) = %q, want %q", version, w.key, got, want)
+		}
+	}
+
+	var keys []string
+	for key := range state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var want []string
+	for _, key := range keys {
+		want = append(want, key+"="+state[key])
+	}
+	if got := iterate(t, v, nil, nil, version); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("version %d: iterated %q, want %q", version, got, want)
+	}
+}
+
+func iterate(t *testing.T, v *VersionedDB, start, end []byte, version int64) []string {
+	t.Helper()
+	itr, err := v.Iterator(start, end, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	var out []string
+	for ; itr.Valid(); itr.Next() {
+		out = append(out, string(itr.Key())+"="+string(itr.Value()))
+	}
+	if err := itr.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestVersionedDBReadAtEveryVersion(t *testing.T) {
+	db := newTestDB(t)
+	v := NewVersionedDB(db, []byte("kv/"), []byte("kvchanges/"))
+	writeHistory(t, db, v, history)
+	for version := int64(0); version <= historyVersions; version++ {
+		checkVersion(t, v, version)
+	}
+	checkVersion(t, v, LatestVersion)
+
+	// Keys stored just after the prefix of the VersionedDB are not read.
+	if err := db.Set([]byte("kv0"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, v, LatestVersion)
+}
+
+func TestVersionedDBIteratorRanges(t *testing.T) {
+	db := newTestDB(t)
+	v := NewVersionedDB(db, []byte("kv/"), []byte("kvchanges/"))
+	writeHistory(t, db, v, history)
+
+	testCases := []struct {
+		name       string
+		start, end string // empty for nil
+		version    int64
+		want       []string
+	}{
+		{name: "from a key", start: "x", version: 4, want: []string{"x=x3", "x\x00=x0", "x\x00\xff=x0ff", "x\xff=xff", "\xff=ff"}},
+		{name: "to a key", end: "x", version: 4, want: []string{"c=c2"}},
+		{name: "zero byte bounds", start: "x\x00", end: "x\x00\xff", version: 4, want: []string{"x\x00=x0"}},
+		{name: "0xFF bound", start: "x\x01", end: "\xff", version: 4, want: []string{"x\xff=xff"}},
+		{name: "deleted key", start: "x\x00", end: "x\x01", version: 5, want: []string{"x\x00\xff=x0ff"}},
+		{name: "earlier version", start: "a", end: "z", version: 2, want: []string{"a=a2", "b=b1", "c=c2", "x\x00=x0"}},
+		{name: "empty range", start: "d", end: "e", version: LatestVersion},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var start, end []byte
+			if tc.start != "" {
+				start = []byte(tc.start)
+			}
+			if tc.end != "" {
+				end = []byte(tc.end)
+			}
+			if got := iterate(t, v, start, end, tc.version); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("iterated %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// PrefixIterator of a key ending with 0x00 only returns the keys starting with it.
+	itr, err := v.PrefixIterator([]byte("x\x00"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	var got [][]byte
+	for ; itr.Valid(); itr.Next() {
+		got = append(got, itr.Key())
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], []byte("x\x00")) || !bytes.Equal(got[1], []byte("x\x00\xff")) {
+		t.Fatalf("prefix iterated %q", got)
+	}
+}
+
+func TestVersionedDBPrune(t *testing.T) {
+	db := newTestDB(t)
+	v := NewVersionedDB(db, []byte("kv/"), []byte("kvchanges/"))
+	writeHistory(t, db, v, history)
+
+	testCases := []struct {
+		version int64
+		deleted int
+	}{
+		// a@1, and b@1 and b@3 since b is deleted at 3.
+		{version: 3, deleted: 3},
+		// Nothing was written since the last pruning.
+		{version: 3, deleted: 0},
+		// a@2 and a@4, and x\x00@1 and x\x00@5.
+		{version: 5, deleted: 4},
+		{version: LatestVersion - 1, deleted: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.version), func(t *testing.T) {
+			batches := 0
+			deleted, err := v.Prune(func() Batch { batches++; return db.NewBatch() }, tc.version, 2, func(int) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tc.deleted {
+				t.Fatalf("deleted %d versions, want %d", deleted, tc.deleted)
+			}
+			if batches == 0 {
+				t.Fatal("no batch created")
+			}
+			for version := min(tc.version, historyVersions); version <= historyVersions; version++ {
+				checkVersion(t, v, version)
+			}
+			checkVersion(t, v, LatestVersion)
+
+			// The change index is pruned with the versions.
+			itr, err := db.Iterator([]byte("kvchanges/"), v.changeKey(tc.version+1, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer itr.Close()
+			if itr.Valid() {
+				t.Fatalf("change %q left after pruning", itr.Key())
+			}
+		})
+	}
+
+	// Only the latest live versions are left.
+	itr, err := db.Iterator([]byte("kv/"), prefixEnd([]byte("kv/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	n := 0
+	for ; itr.Valid(); itr.Next() {
+		n++
+	}
+	if want := len(stateAt(history, LatestVersion)); n != want {
+		t.Fatalf("%d versions left, want %d", n, want)
+	}
+}
+
+func TestVersionedDBPruneWithoutChangeIndex(t *testing.T) {
+	db := newTestDB(t)
+	v := NewVersionedDB(db, []byte("kv/"), []byte("kvchanges/")).IndexChanges(false)
+	writeHistory(t, db, v, history)
+
+	itr, err := db.Iterator([]byte("kvchanges/"), prefixEnd([]byte("kvchanges/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itr.Valid() {
+		t.Fatalf("change %q indexed", itr.Key())
+	}
+	itr.Close()
+
+	// Nothing is pruned until a key is written again with the index.
+	prune := func(version int64) int {
+		deleted, err := v.Prune(func() Batch { return db.NewBatch() }, version, 2, func(int) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return deleted
+	}
+	if deleted := prune(historyVersions); deleted != 0 {
+		t.Fatalf("deleted %d versions without the index", deleted)
+	}
+	checkVersion(t, v, LatestVersion)
+
+	v = v.IndexChanges(true)
+	batch := db.NewBatch()
+	defer batch.Close()
+	if err := v.Set(batch, []byte("a"), []byte("a6"), historyVersions+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+	// a@1, a@2, a@4 and a@5.
+	if deleted := prune(historyVersions + 1); deleted != 4 {
+		t.Fatalf("deleted %d versions, want 4", deleted)
+	}
+	if value, err := v.Get([]byte("a"), LatestVersion); err != nil || string(value) != "a6" {
+		t.Fatalf("Get(a) = %q, %v after pruning", value, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+
+	db "kvstore/database"
+)
+
+// pendingBlock is a block finalized by FinalizeBlock and not yet committed. Its writes are held
+// in batch until Commit writes it.
+type pendingBlock struct {
+	state appState
+	batch db.Batch
+}
+
+// beginBlock checks that the block at height can be finalized. Blocks are finalized in order,
+// each one committed before the next one is finalized, but the pending block can be finalized
+// again, in which case its writes are discarded.
+func (app *KVStoreApplication) beginBlock(height int64) error {
+	if p := app.pending; p != nil {
+		if p.state.Height != height {
+			return fmt.Errorf("cannot finalize block %d, block %d was finalized but not committed", height, p.state.Height)
+		}
+		app.logger.Info("abci", "method", "FinalizeBlock", "msg", "finalizing block again, discarding its pending writes", "height", height)
+		if err := p.batch.Close(); err != nil {
+			return err
+		}
+		app.pending = nil
+	}
+	if height <= 0 {
+		return fmt.Errorf("cannot finalize block %d, heights start at 1", height)
+	}
+	// The first block is at the initial height of the chain, stored by InitChain.
+	if app.state.Height == 0 && height != app.initialHeight {
+		return fmt.Errorf("cannot finalize block %d, the chain starts at height %d", height, app.initialHeight)
+	}
+	if app.state.Height != 0 && height != app.state.Height+1 {
+		return fmt.Errorf("cannot finalize block %d, the last committed block is %d", height, app.state.Height)
+	}
+	if height == app.finalizedHeight {
+		app.logger.Info("abci", "method", "FinalizeBlock", "msg", "finalizing again the block that was not committed before the restart", "height", height)
+	}
+	return nil
+}
+
+// blockExec is the state of the block being executed by FinalizeBlock.
+type blockExec struct {
+	height       int64
+	w            *stateWriter
+	vals         validatorSet
+	params       *cmtproto.ConsensusParams
+	paramsUpdate *paramsUpdate
+	valUpdates   []abcitypes.ValidatorUpdate
+
+	// index is the index in the block of the transaction being executed, and tx that
+	// transaction as it is in the block, before any wrapper is removed.
+	index int
+	tx    []byte
+}
+
+// execTx executes a transaction of the block. It only returns an error if the block cannot be
+// executed, transactions failing for other reasons have a non-zero code in their result.
+func (app *KVStoreApplication) execTx(b *blockExec, tx []byte) (*abcitypes.ExecTxResult, error) {
+	if code, err := app.isValid(tx); code != 0 {
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid tx", "code", code, "err", err)
+		return &abcitypes.ExecTxResult{Code: code, Log: err.Error(), Codespace: codespace}, nil
+	}
+
+	switch {
+	case isFeeTx(tx):
+		ftx, _ := parseFeeTx(tx)
+		return app.execTx(b, ftx.tx)
+
+	case isLaneTx(tx):
+		ltx, _ := parseLaneTx(tx)
+		return app.execTx(b, ltx.tx)
+
+	case isSignedTx(tx):
+		return app.execSignedTx(b, tx)
+
+	case isValidatorTx(tx):
+		val, _ := parseValidatorTx(tx)
+		if err := b.vals.check(val, b.params.GetValidator().GetPubKeyTypes()); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid validator update", "err", err)
+			return &abcitypes.ExecTxResult{Code: codeTypeInvalidValidatorTx, Log: err.Error(), Codespace: codespace}, nil
+		}
+		if err := b.vals.apply(b.w, val); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error updating validator", "err", err)
+			return nil, err
+		}
+		b.valUpdates = append(b.valUpdates, val)
+		return &abcitypes.ExecTxResult{
+			Code: 0,
+			Events: []abcitypes.Event{
+				{
+					Type: "validator",
+					Attributes: []abcitypes.EventAttribute{
+						{Key: "pub_key", Value: string(tx[len(validatorTxPrefix):bytes.IndexByte(tx, '!')]), Index: true},
+						{Key: "power", Value: fmt.Sprint(val.Power), Index: true},
+					},
+				},
+			},
+		}, nil
+
+	case isOracleTx(tx):
+		return app.execOracleTx(b, tx)
+
+	case isParamsTx(tx):
+		changes, _ := parseParamsTx(tx)
+		if err := b.paramsUpdate.apply(changes, b.height); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid consensus params update", "err", err)
+			return &abcitypes.ExecTxResult{Code: codeTypeInvalidParamsTx, Log: err.Error(), Codespace: codespace}, nil
+		}
+		var attrs []abcitypes.EventAttribute
+		for _, change := range changes {
+			attrs = append(attrs, abcitypes.EventAttribute{Key: change.name, Value: change.value, Index: true})
+		}
+		return &abcitypes.ExecTxResult{
+			Code:   0,
+			Events: []abcitypes.Event{{Type: "consensus_params", Attributes: attrs}},
+		}, nil
+
+	default:
+		ops, _ := parseOps(tx)
+		batch := newOpBatch(b.w.Get)
+		var events []abcitypes.Event
+		for _, o := range ops {
+			event, err := batch.apply(o)
+			var opErr *opError
+			if errors.As(err, &opErr) {
+				app.logger.Info("abci", "method", "FinalizeBlock", "msg", "transaction failed", "code", opErr.code, "err", opErr)
+				return &abcitypes.ExecTxResult{Code: opErr.code, Log: opErr.Error(), Codespace: codespace}, nil
+			}
+			if err != nil {
+				app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error applying op", "err", err)
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		if err := batch.flush(b.w); err != nil {
+			app.logger.Error("abci", "method", "FinalizeBlock", "msg", "error setting batch", "err", err)
+			return nil, err
+		}
+		return &abcitypes.ExecTxResult{Code: 0, Events: events}, nil
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestBlockLifecycle(t *testing.T) {
+	type step struct {
+		commit  bool
+		restart bool  // reopens the application from its database
+		height  int64 // the height of the block to finalize, if not commit or restart
+		txs     []string
+		err     bool
+	}
+	testCases := []struct {
+		name          string
+		initialHeight int64 // the initial height sent to InitChain
+		steps         []step
+		height        int64  // the last committed height
+		kvs           string // the key/value pairs at the last committed height
+	}{
+		{
+			name:  "commit before finalize",
+			steps: []step{{commit: true, err: true}},
+			kvs:   "[]",
+		},
+		{
+			name:   "blocks in order",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {commit: true}, {height: 2, txs: []string{"b=2"}}, {commit: true}},
+			height: 2,
+			kvs:    "[a=1 b=2]",
+		},
+		{
+			name:  "finalize at height 0",
+			steps: []step{{height: 0, err: true}},
+			kvs:   "[]",
+		},
+		{
+			name:   "finalize skipping a height",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {commit: true}, {height: 3, txs: []string{"b=2"}, err: true}, {commit: true, err: true}},
+			height: 1,
+			kvs:    "[a=1]",
+		},
+		{
+			name:   "finalize a committed height",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {commit: true}, {height: 1, txs: []string{"b=2"}, err: true}},
+			height: 1,
+			kvs:    "[a=1]",
+		},
+		{
+			name:   "finalize again",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {height: 1, txs: []string{"b=2"}}, {commit: true}},
+			height: 1,
+			kvs:    "[b=2]",
+		},
+		{
+			name:   "finalize another height before commit",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {height: 2, txs: []string{"b=2"}, err: true}, {commit: true}},
+			height: 1,
+			kvs:    "[a=1]",
+		},
+		{
+			name:          "blocks from the initial height",
+			initialHeight: 5,
+			steps:         []step{{height: 5, txs: []string{"a=1"}}, {commit: true}, {height: 6, txs: []string{"b=2"}}, {commit: true}},
+			height:        6,
+			kvs:           "[a=1 b=2]",
+		},
+		{
+			name:          "finalize before the initial height",
+			initialHeight: 5,
+			steps:         []step{{height: 1, txs: []string{"a=1"}, err: true}, {height: 4, txs: []string{"a=1"}, err: true}, {commit: true, err: true}},
+			kvs:           "[]",
+		},
+		{
+			name:          "finalize after the initial height",
+			initialHeight: 5,
+			steps:         []step{{height: 6, txs: []string{"a=1"}, err: true}},
+			kvs:           "[]",
+		},
+		{
+			name:          "initial height after a restart",
+			initialHeight: 5,
+			steps:         []step{{restart: true}, {height: 1, txs: []string{"a=1"}, err: true}, {height: 5, txs: []string{"a=1"}}, {commit: true}},
+			height:        5,
+			kvs:           "[a=1]",
+		},
+		{
+			name:   "commit twice",
+			steps:  []step{{height: 1, txs: []string{"a=1"}}, {commit: true}, {commit: true, err: true}},
+			height: 1,
+			kvs:    "[a=1]",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, DefaultConfig())
+			_, err := app.InitChain(context.Background(), &abcitypes.InitChainRequest{
+				ChainId:       testChainID,
+				InitialHeight: tc.initialHeight,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var finalized int64
+			for i, s := range tc.steps {
+				var err error
+				if s.restart {
+					if app, err = openTestApp(t, app.db, DefaultConfig()); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if s.commit {
+					_, err = app.Commit(context.Background(), &abcitypes.CommitRequest{})
+				} else {
+					req := &abcitypes.FinalizeBlockRequest{Height: s.height}
+					for _, tx := range s.txs {
+						req.Txs = append(req.Txs, []byte(tx))
+					}
+					_, err = app.FinalizeBlock(context.Background(), req)
+				}
+				if s.err != (err != nil) {
+					t.Fatalf("step %d: error %v, expected one: %v", i, err, s.err)
+				}
+				if err == nil && s.commit {
+					finalized = 0
+				} else if err == nil {
+					finalized = s.height
+				}
+				// The finalized height is recorded until the block is committed.
+				if height, err := loadFinalizedHeight(app.db); err != nil || height != finalized {
+					t.Fatalf("step %d: finalized height %d, %v, want %d", i, height, err, finalized)
+				}
+			}
+			if app.state.Height != tc.height {
+				t.Fatalf("committed height %d, want %d", app.state.Height, tc.height)
+			}
+			if kvs := userKVs(t, app); kvs != tc.kvs {
+				t.Fatalf("store %s, want %s", kvs, tc.kvs)
+			}
+		})
+	}
+}
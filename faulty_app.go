@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// faultyApp wraps the application to inject faults in every ABCI method, before the method of
+// the application is called. The faults are changed at runtime through the admin server.
+type faultyApp struct {
+	app *KVStoreApplication
+}
+
+var _ abcitypes.Application = (*faultyApp)(nil)
+
+func newFaultyApp(app *KVStoreApplication) *faultyApp {
+	return &faultyApp{app: app}
+}
+
+// before injects the faults of method: it delays it, then returns the error it fails with or
+// panics. Methods are called one at a time by the ABCI server, so the height of the block being
+// decided is the one after the last committed height.
+func (a *faultyApp) before(method string) error {
+	height := a.app.state.Height + 1
+	if delay, ok := (*a.app.latencies.Load())[method]; ok {
+		if d := delay.sample(height); d > 0 {
+			a.app.logger.Debug("abci", "method", method, "msg", "delaying", "height", height, "delay", d)
+			time.Sleep(d)
+		}
+	}
+	fault, ok := (*a.app.methodFaults.Load())[method]
+	if !ok || !fault.trigger(height) {
+		return nil
+	}
+	a.app.logger.Error("abci", "method", method, "msg", "injecting fault", "height", height, "kind", fault.Kind)
+	err := fmt.Errorf("injected %s in %s at height %d", fault.Kind, method, height)
+	if fault.Kind == MethodFaultPanic {
+		panic(err)
+	}
+	return err
+}
+
+func (a *faultyApp) Info(ctx context.Context, req *abcitypes.InfoRequest) (*abcitypes.InfoResponse, error) {
+	if err := a.before("Info"); err != nil {
+		return nil, err
+	}
+	return a.app.Info(ctx, req)
+}
+
+func (a *faultyApp) Query(ctx context.Context, req *abcitypes.QueryRequest) (*abcitypes.QueryResponse, error) {
+	if err := a.before("Query"); err != nil {
+		return nil, err
+	}
+	return a.app.Query(ctx, req)
+}
+
+func (a *faultyApp) CheckTx(ctx context.Context, req *abcitypes.CheckTxRequest) (*abcitypes.CheckTxResponse, error) {
+	if err := a.before("CheckTx"); err != nil {
+		return nil, err
+	}
+	return a.app.CheckTx(ctx, req)
+}
+
+func (a *faultyApp) InitChain(ctx context.Context, req *abcitypes.InitChainRequest) (*abcitypes.InitChainResponse, error) {
+	if err := a.before("InitChain"); err != nil {
+		return nil, err
+	}
+	return a.app.InitChain(ctx, req)
+}
+
+func (a *faultyApp) PrepareProposal(ctx context.Context, req *abcitypes.PrepareProposalRequest) (*abcitypes.PrepareProposalResponse, error) {
+	if err := a.before("PrepareProposal"); err != nil {
+		return nil, err
+	}
+	return a.app.PrepareProposal(ctx, req)
+}
+
+func (a *faultyApp) ProcessProposal(ctx context.Context, req *abcitypes.ProcessProposalRequest) (*abcitypes.ProcessProposalResponse, error) {
+	if err := a.before("ProcessProposal"); err != nil {
+		return nil, err
+	}
+	return a.app.ProcessProposal(ctx, req)
+}
+
+func (a *faultyApp) FinalizeBlock(ctx context.Context, req *abcitypes.FinalizeBlockRequest) (*abcitypes.FinalizeBlockResponse, error) {
+	if err := a.before("FinalizeBlock"); err != nil {
+		return nil, err
+	}
+	return a.app.FinalizeBlock(ctx, req)
+}
+
+func (a *faultyApp) ExtendVote(ctx context.Context, req *abcitypes.ExtendVoteRequest) (*abcitypes.ExtendVoteResponse, error) {
+	if err := a.before("ExtendVote"); err != nil {
+		return nil, err
+	}
+	return a.app.ExtendVote(ctx, req)
+}
+
+func (a *faultyApp) VerifyVoteExtension(ctx context.Context, req *abcitypes.VerifyVoteExtensionRequest) (*abcitypes.VerifyVoteExtensionResponse, error) {
+	if err := a.before("VerifyVoteExtension"); err != nil {
+		return nil, err
+	}
+	return a.app.VerifyVoteExtension(ctx, req)
+}
+
+func (a *faultyApp) Commit(ctx context.Context, req *abcitypes.CommitRequest) (*abcitypes.CommitResponse, error) {
+	if err := a.before("Commit"); err != nil {
+		return nil, err
+	}
+	return a.app.Commit(ctx, req)
+}
+
+func (a *faultyApp) ListSnapshots(ctx context.Context, req *abcitypes.ListSnapshotsRequest) (*abcitypes.ListSnapshotsResponse, error) {
+	if err := a.before("ListSnapshots"); err != nil {
+		return nil, err
+	}
+	return a.app.ListSnapshots(ctx, req)
+}
+
+func (a *faultyApp) OfferSnapshot(ctx context.Context, req *abcitypes.OfferSnapshotRequest) (*abcitypes.OfferSnapshotResponse, error) {
+	if err := a.before("OfferSnapshot"); err != nil {
+		return nil, err
+	}
+	return a.app.OfferSnapshot(ctx, req)
+}
+
+func (a *faultyApp) LoadSnapshotChunk(ctx context.Context, req *abcitypes.LoadSnapshotChunkRequest) (*abcitypes.LoadSnapshotChunkResponse, error) {
+	if err := a.before("LoadSnapshotChunk"); err != nil {
+		return nil, err
+	}
+	return a.app.LoadSnapshotChunk(ctx, req)
+}
+
+func (a *faultyApp) ApplySnapshotChunk(ctx context.Context, req *abcitypes.ApplySnapshotChunkRequest) (*abcitypes.ApplySnapshotChunkResponse, error) {
+	if err := a.before("ApplySnapshotChunk"); err != nil {
+		return nil, err
+	}
+	return a.app.ApplySnapshotChunk(ctx, req)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/cometbft/cometbft/crypto"
+)
+
+// feeTxPrefix starts the transactions paying a fee, of the form fee:<amount>!<tx> where tx is
+// any transaction without a fee. The fee is not charged, it only sets the priority of tx. A fee
+// transaction is inside the signed transaction, if any, so that the signature covers the fee.
+const feeTxPrefix = "fee:"
+
+const (
+	// gasPerTx is the gas wanted by every transaction.
+	gasPerTx int64 = 1000
+
+	// gasPerByte is the gas wanted for every byte of a transaction.
+	gasPerByte int64 = 10
+
+	// gasPerSignature is the gas wanted for verifying the signature of a signed transaction.
+	gasPerSignature int64 = 1000
+)
+
+type feeTx struct {
+	fee int64
+	tx  []byte
+}
+
+func isFeeTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(feeTxPrefix))
+}
+
+func parseFeeTx(tx []byte) (*feeTx, error) {
+	feeStr, inner, ok := bytes.Cut(tx[len(feeTxPrefix):], []byte("!"))
+	if !ok {
+		return nil, errors.New("expected fee:<amount>!<tx>")
+	}
+	fee, err := strconv.ParseInt(string(feeStr), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing fee: %w", err)
+	}
+	if fee < 0 {
+		return nil, fmt.Errorf("negative fee %d", fee)
+	}
+	return &feeTx{fee: fee, tx: inner}, nil
+}
+
+// txWrapper returns the name of the wrapper tx is, "" if it is not a fee, lane or signed
+// transaction.
+func txWrapper(tx []byte) string {
+	switch {
+	case isFeeTx(tx):
+		return "fee"
+	case isLaneTx(tx):
+		return "lane"
+	case isSignedTx(tx):
+		return "signed"
+	default:
+		return ""
+	}
+}
+
+// txMeta is the metadata of a valid transaction that CheckTx reports to the mempool.
+type txMeta struct {
+	gas      int64
+	priority int64
+	sender   crypto.Address
+	lane     string
+	keys     [][]byte
+}
+
+// getTxMeta returns the metadata of a valid transaction. Its priority is its fee, its sender is
+// the account of the signed transaction it is or it holds, if any, and its lane is the lane it
+// is tagged with, if any. The keys are the keys written by the key/value ops of the transaction.
+func getTxMeta(tx []byte) txMeta {
+	meta := txMeta{gas: gasPerTx + gasPerByte*int64(len(tx))}
+	for {
+		switch {
+		case isFeeTx(tx):
+			ftx, _ := parseFeeTx(tx)
+			meta.priority = ftx.fee
+			tx = ftx.tx
+		case isSignedTx(tx):
+			stx, _ := parseSignedTx(tx)
+			meta.gas += gasPerSignature
+			meta.sender = stx.pubKey.Address()
+			tx = stx.tx
+		case isLaneTx(tx):
+			ltx, _ := parseLaneTx(tx)
+			meta.lane = ltx.lane
+			tx = ltx.tx
+		case isValidatorTx(tx), isParamsTx(tx):
+			return meta
+		default:
+			ops, _ := parseOps(tx)
+			for _, o := range ops {
+				meta.keys = append(meta.keys, o.key)
+			}
+			return meta
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+// eventAttributes returns the attributes of the events of the given type.
+func eventAttributes(events []abcitypes.Event, typ string) map[string]string {
+	attrs := map[string]string{}
+	for _, event := range events {
+		if event.Type != typ {
+			continue
+		}
+		for _, attr := range event.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+	}
+	return attrs
+}
+
+func TestCheckTxMetadata(t *testing.T) {
+	priv := ed25519.GenPrivKey()
+	signed := func(tx string) string { return signTx(t, priv, testChainID, 0, tx) }
+
+	testCases := []struct {
+		name     string
+		tx       string
+		code     uint32
+		priority string
+		signed   bool // whether the sender is the account of priv
+	}{
+		{name: "plain", tx: "k=v", priority: "0"},
+		{name: "fee", tx: "fee:5!k=v", priority: "5"},
+		{name: "fee and lane", tx: "fee:5!lane:a!k=v", priority: "5"},
+		{name: "lane and fee", tx: "lane:a!fee:5!k=v", priority: "5"},
+		{name: "signed", tx: signed("k=v"), priority: "0", signed: true},
+		{name: "fee in signed", tx: signed("fee:7!lane:a!k=v"), priority: "7", signed: true},
+		{name: "negative fee", tx: "fee:-1!k=v", code: codeTypeInvalidTxFormat},
+		{name: "nested fee", tx: "fee:1!fee:2!k=v", code: codeTypeInvalidTxFormat},
+		{name: "fee nested under a lane", tx: "fee:1!lane:a!fee:2!k=v", code: codeTypeInvalidTxFormat},
+		{name: "nested lane", tx: "lane:a!lane:b!k=v", code: codeTypeInvalidTxFormat},
+		{name: "lane nested under a fee", tx: "lane:a!fee:1!lane:b!k=v", code: codeTypeInvalidTxFormat},
+		{name: "nested signed", tx: signed(signed("k=v")), code: codeTypeInvalidTxFormat},
+		{name: "fee outside signed", tx: "fee:5!" + signed("k=v"), code: codeTypeInvalidTxFormat},
+		{name: "lane outside signed", tx: "lane:a!" + signed("k=v"), code: codeTypeInvalidTxFormat},
+		{name: "fee twice around signed", tx: signed("fee:1!lane:a!fee:2!k=v"), code: codeTypeInvalidTxFormat},
+		{name: "oracle in fee", tx: `fee:5!oracle:{}`, code: codeTypeInvalidOracleTx},
+		{name: "reserved key", tx: "fee:5!_val/x=1", code: codeTypeReservedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, `{}`)
+			resp, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tc.tx), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tc.code {
+				t.Fatalf("code %d (%s), want %d", resp.Code, resp.Log, tc.code)
+			}
+			if tc.code != codeTypeOK {
+				if resp.Codespace != codespace || resp.Info != codeNames[tc.code] || resp.Log == "" {
+					t.Fatalf("rejection codespace %q, info %q, log %q", resp.Codespace, resp.Info, resp.Log)
+				}
+				// FinalizeBlock rejects the transactions CheckTx rejects for their format.
+				if result := finalizeBlock(t, app, 1, tc.tx).TxResults[0]; result.Code != tc.code {
+					t.Fatalf("FinalizeBlock code %d (%s), want %d", result.Code, result.Log, tc.code)
+				}
+				return
+			}
+
+			gas := gasPerTx + gasPerByte*int64(len(tc.tx))
+			sender := ""
+			if tc.signed {
+				gas += gasPerSignature
+				sender = priv.PubKey().Address().String()
+			}
+			if resp.GasWanted != gas {
+				t.Fatalf("gas wanted %d, want %d", resp.GasWanted, gas)
+			}
+			attrs := eventAttributes(resp.Events, "tx")
+			if attrs["priority"] != tc.priority || attrs["sender"] != sender {
+				t.Fatalf("priority %q and sender %q, want %q and %q", attrs["priority"], attrs["sender"], tc.priority, sender)
+			}
+		})
+	}
+}
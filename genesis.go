@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	cmttypes "github.com/cometbft/cometbft/types"
+
+	db "kvstore/database"
+)
+
+// configKey is the key under which the configuration set by the genesis app_state is stored.
+var configKey = []byte("_config")
+
+// genesisState is the app_state of the genesis file. All fields are optional.
+type genesisState struct {
+	// KVs are the initial key/value pairs.
+	KVs map[string]string `json:"kvs"`
+
+	// Config overrides the configuration of every node, see Config for the fields.
+	Config json.RawMessage `json:"config"`
+
+	// Validators replaces the validators of the genesis file.
+	Validators []genesisValidator `json:"validators"`
+
+	// ConsensusParams overrides consensus parameters of the genesis file, with the names of
+	// params: transactions.
+	ConsensusParams map[string]string `json:"consensus_params"`
+}
+
+type genesisValidator struct {
+	PubKey []byte `json:"pub_key"`
+	Power  int64  `json:"power"`
+}
+
+func parseGenesisState(bz []byte) (*genesisState, error) {
+	genesis := &genesisState{}
+	// CometBFT sends an empty JSON string when the genesis file has no app_state.
+	if bz = bytes.TrimSpace(bz); len(bz) == 0 || string(bz) == `""` {
+		return genesis, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(genesis); err != nil {
+		return nil, fmt.Errorf("decoding app_state: %w", err)
+	}
+
+	for key := range genesis.KVs {
+		if len(key) == 0 || bytes.HasPrefix([]byte(key), reservedPrefix) {
+			return nil, fmt.Errorf("invalid key %q in app_state", key)
+		}
+	}
+	if len(genesis.Config) != 0 {
+		if _, err := DefaultConfig().withGenesisConfig(genesis.Config); err != nil {
+			return nil, err
+		}
+	}
+	return genesis, nil
+}
+
+func decodeConfig(bz []byte, cfg *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("decoding config: %w", err)
+	}
+	return nil
+}
+
+// consensusParams returns the genesis consensus parameters with the overrides of the app_state
+// applied, and the update to return to CometBFT, nil if there are no overrides.
+func (g *genesisState) consensusParams(params *cmtproto.ConsensusParams) (*cmtproto.ConsensusParams, *cmtproto.ConsensusParams, error) {
+	if len(g.ConsensusParams) == 0 {
+		return params, nil, nil
+	}
+	next := cmttypes.DefaultConsensusParams()
+	if params != nil {
+		p := cmttypes.ConsensusParamsFromProto(*params)
+		next = &p
+	}
+	var changes []paramChange
+	for name, value := range g.ConsensusParams {
+		change, err := newParamChange(name, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, change)
+	}
+	groups := map[string]bool{}
+	if err := setParams(next, changes, groups); err != nil {
+		return nil, nil, err
+	}
+	if err := next.ValidateBasic(); err != nil {
+		return nil, nil, fmt.Errorf("invalid consensus params in app_state: %w", err)
+	}
+	full := next.ToProto()
+	return &full, protoUpdate(*next, groups), nil
+}
+
+// validators returns the validators of the app_state, or nil if it does not replace the
+// validators of the genesis file. Only the public key types in pubKeyTypes are accepted.
+func (g *genesisState) validators(pubKeyTypes []string) ([]abcitypes.ValidatorUpdate, error) {
+	var vals []abcitypes.ValidatorUpdate
+	seen := map[string]bool{}
+	for _, v := range g.Validators {
+		if seen[string(v.PubKey)] {
+			return nil, fmt.Errorf("duplicate validator %X", v.PubKey)
+		}
+		seen[string(v.PubKey)] = true
+		val, err := newValidatorUpdate(v.PubKey, v.Power)
+		if err != nil {
+			return nil, err
+		}
+		if val.Power == 0 {
+			return nil, fmt.Errorf("validator %X has no power", v.PubKey)
+		}
+		pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(pubKeyTypes, pubKey.Type()) {
+			return nil, fmt.Errorf("public key type %s is not allowed, expected one of %v", pubKey.Type(), pubKeyTypes)
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
+}
+
+// loadGenesisConfig loads the chain ID stored at InitChain, and overlays the configuration stored
+// from the genesis app_state, if any, on the configuration of the application. It fails if the
+// resulting configuration is not valid. The store indexes its writes if the configuration prunes.
+func (app *KVStoreApplication) loadGenesisConfig() error {
+	chainID, err := app.store.Get(chainIDKey, db.LatestVersion)
+	if err != nil {
+		return err
+	}
+	app.chainID = string(chainID)
+	bz, err := app.store.Get(configKey, db.LatestVersion)
+	if err != nil {
+		return err
+	}
+	cfg, err := app.cfg.withGenesisConfig(bz)
+	if err != nil {
+		return err
+	}
+	app.cfg = cfg
+	// The writes are only indexed for pruning, the index would grow forever otherwise.
+	app.store = app.store.IndexChanges(cfg.RetainBlocks > 0 || cfg.RetainFromSnapshot)
+	return nil
+}
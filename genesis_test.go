@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+func TestGenesisConfigMergedWithNodeConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		node    func(cfg *Config)
+		genesis string
+		valid   bool
+	}{
+		{
+			name:    "valid",
+			node:    func(cfg *Config) { cfg.RetainFromSnapshot, cfg.SnapshotInterval = true, 5 },
+			genesis: `{"config": {"snapshot_interval": 10, "max_key_size": 64}}`,
+			valid:   true,
+		},
+		{
+			name:    "genesis config invalid with the node config",
+			node:    func(cfg *Config) { cfg.RetainFromSnapshot, cfg.SnapshotInterval = true, 5 },
+			genesis: `{"config": {"snapshot_interval": 0}}`,
+		},
+		{
+			name:    "invalid genesis config",
+			node:    func(cfg *Config) {},
+			genesis: `{"config": {"retain_blocks": -1}}`,
+		},
+		{
+			name:    "unknown field",
+			node:    func(cfg *Config) {},
+			genesis: `{"config": {"unknown": 1}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.node(&cfg)
+			pebble, err := db.NewPebbleDB("test", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pebble.Close()
+			app, err := openTestApp(t, pebble, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = app.InitChain(context.Background(), &abcitypes.InitChainRequest{
+				ChainId:       testChainID,
+				AppStateBytes: []byte(tc.genesis),
+			})
+			if !tc.valid {
+				if err == nil {
+					t.Fatal("expected InitChain to fail")
+				}
+				if bz, err := pebble.Get(stateKey); err != nil || bz != nil {
+					t.Fatalf("state %q, %v written by a failed InitChain", bz, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The merged configuration is valid when the node restarts too.
+			restarted, err := openTestApp(t, pebble, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !restarted.cfg.RetainFromSnapshot || restarted.cfg.SnapshotInterval != 10 || restarted.cfg.MaxKeySize != 64 {
+				t.Fatalf("merged config %+v", restarted.cfg)
+			}
+			if cfg.SnapshotInterval != 5 {
+				t.Fatal("node config changed by the merge")
+			}
+		})
+	}
+}
+
+func TestRestoreKeepsRuntimeFaults(t *testing.T) {
+	const genesis = `{"config": {"latencies": {"Info": {"duration": "1ms"}}}}`
+	source := newTestApp(t, DefaultConfig())
+	initChain(t, source, genesis)
+	commitBlock(t, source, 1, "a=1")
+
+	target := newTestApp(t, DefaultConfig())
+	initChain(t, target, genesis)
+	// Set through the admin server.
+	latencies := &Latencies{}
+	target.latencies.Store(latencies)
+	restoreSnapshot(t, source, target, 1)
+	if target.latencies.Load() != latencies {
+		t.Fatalf("latencies %v after the restore, want the ones set at runtime", *target.latencies.Load())
+	}
+}
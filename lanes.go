@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// laneTxPrefix starts the transactions tagged with a mempool lane, of the form
+// lane:<name>!<tx> where tx is any transaction without a lane tag.
+const laneTxPrefix = "lane:"
+
+// Lane is a mempool lane. Transactions are assigned to the lane they are tagged with, or else to
+// the first lane with a key prefix matching one of the keys they write, or else to the default
+// lane.
+//
+// The ABCI of the CometBFT version this application is built with has no lanes: they are
+// described in the Data of the Info response, see infoData, and the lane of a transaction is
+// reported in the events of CheckTx.
+type Lane struct {
+	Name        string   `json:"name"`
+	Priority    uint32   `json:"priority"`
+	KeyPrefixes []string `json:"key_prefixes"`
+}
+
+// parseLane parses a lane of the form <name>:<priority>[:<key prefix>,<key prefix>...].
+func parseLane(s string) (Lane, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return Lane{}, errors.New("expected <name>:<priority>[:<key prefix>,...]")
+	}
+	priority, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return Lane{}, fmt.Errorf("parsing priority: %w", err)
+	}
+	lane := Lane{Name: parts[0], Priority: uint32(priority)}
+	if len(parts) == 3 {
+		lane.KeyPrefixes = strings.Split(parts[2], ",")
+	}
+	return lane, nil
+}
+
+type laneTx struct {
+	lane string
+	tx   []byte
+}
+
+func isLaneTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(laneTxPrefix))
+}
+
+func parseLaneTx(tx []byte) (*laneTx, error) {
+	name, inner, ok := bytes.Cut(tx[len(laneTxPrefix):], []byte("!"))
+	if !ok || len(name) == 0 {
+		return nil, errors.New("expected lane:<name>!<tx>")
+	}
+	return &laneTx{lane: string(name), tx: inner}, nil
+}
+
+// validateLanes checks that the lanes have distinct names and that the default lane is one of
+// them.
+func (cfg Config) validateLanes() error {
+	if len(cfg.Lanes) == 0 {
+		if cfg.DefaultLane != "" {
+			return fmt.Errorf("default lane %q is not a lane", cfg.DefaultLane)
+		}
+		return nil
+	}
+	names := map[string]bool{}
+	for _, lane := range cfg.Lanes {
+		if names[lane.Name] {
+			return fmt.Errorf("duplicate lane %q", lane.Name)
+		}
+		names[lane.Name] = true
+	}
+	if !names[cfg.DefaultLane] {
+		return fmt.Errorf("default lane %q is not a lane", cfg.DefaultLane)
+	}
+	return nil
+}
+
+// lane returns the lane of a valid transaction with the given metadata, or "" if there are no
+// lanes. Transactions tagged with an unknown lane go to the default lane.
+func (cfg Config) lane(meta txMeta) string {
+	if meta.lane != "" {
+		for _, lane := range cfg.Lanes {
+			if lane.Name == meta.lane {
+				return lane.Name
+			}
+		}
+		return cfg.DefaultLane
+	}
+	for _, lane := range cfg.Lanes {
+		for _, prefix := range lane.KeyPrefixes {
+			for _, key := range meta.keys {
+				if bytes.HasPrefix(key, []byte(prefix)) {
+					return lane.Name
+				}
+			}
+		}
+	}
+	return cfg.DefaultLane
+}
+
+// laneInfo describes the lanes in the Data of the Info response, with the fields of the Info
+// response of the CometBFT versions with lanes.
+type laneInfo struct {
+	LanePriorities map[string]uint32 `json:"lane_priorities"`
+	DefaultLane    string            `json:"default_lane"`
+}
+
+// infoData returns the Data of the Info response: the name of the application, followed by the
+// JSON laneInfo of the lanes if there are any.
+func (cfg Config) infoData() (string, error) {
+	if len(cfg.Lanes) == 0 {
+		return "kvstore++", nil
+	}
+	info := laneInfo{LanePriorities: map[string]uint32{}, DefaultLane: cfg.DefaultLane}
+	for _, lane := range cfg.Lanes {
+		info.LanePriorities[lane.Name] = lane.Priority
+	}
+	bz, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return "kvstore++ " + string(bz), nil
+}
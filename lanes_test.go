@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestCheckTxLane(t *testing.T) {
+	lanes := func(cfg *Config) {
+		cfg.Lanes = []Lane{{Name: "fast", Priority: 10, KeyPrefixes: []string{"f/"}}, {Name: "slow", Priority: 1}}
+		cfg.DefaultLane = "slow"
+	}
+	testCases := []struct {
+		name string
+		cfg  func(cfg *Config)
+		tx   string
+		lane string
+	}{
+		{name: "no lanes", cfg: func(cfg *Config) {}, tx: "lane:fast!k=v", lane: ""},
+		{name: "tagged", cfg: lanes, tx: "lane:fast!k=v", lane: "fast"},
+		{name: "unknown tag", cfg: lanes, tx: "lane:other!f/k=v", lane: "slow"},
+		{name: "key prefix", cfg: lanes, tx: "multi:k=1;f/k=2", lane: "fast"},
+		{name: "tag over key prefix", cfg: lanes, tx: "lane:slow!f/k=v", lane: "slow"},
+		{name: "default", cfg: lanes, tx: "k=v", lane: "slow"},
+		{name: "in a fee transaction", cfg: lanes, tx: "fee:1!lane:fast!k=v", lane: "fast"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			app := newTestApp(t, cfg)
+			initChain(t, app, `{}`)
+			resp, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tc.tx), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != codeTypeOK {
+				t.Fatalf("code %d (%s)", resp.Code, resp.Log)
+			}
+			if lane := eventAttributes(resp.Events, "tx")["lane"]; lane != tc.lane {
+				t.Fatalf("lane %q, want %q", lane, tc.lane)
+			}
+		})
+	}
+}
+
+func TestInfoLanes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     func(cfg *Config)
+		genesis string
+		data    string
+	}{
+		{
+			name:    "no lanes",
+			cfg:     func(cfg *Config) {},
+			genesis: `{}`,
+			data:    "kvstore++",
+		},
+		{
+			name: "node lanes",
+			cfg: func(cfg *Config) {
+				cfg.Lanes = []Lane{{Name: "fast", Priority: 10}, {Name: "slow", Priority: 1}}
+				cfg.DefaultLane = "slow"
+			},
+			genesis: `{}`,
+			data:    `kvstore++ {"lane_priorities":{"fast":10,"slow":1},"default_lane":"slow"}`,
+		},
+		{
+			name:    "genesis lanes",
+			cfg:     func(cfg *Config) {},
+			genesis: `{"config": {"lanes": [{"name": "a", "priority": 3}], "default_lane": "a"}}`,
+			data:    `kvstore++ {"lane_priorities":{"a":3},"default_lane":"a"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			app := newTestApp(t, cfg)
+			initChain(t, app, tc.genesis)
+			info, err := app.Info(context.Background(), &abcitypes.InfoRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Data != tc.data {
+				t.Fatalf("info data %s, want %s", info.Data, tc.data)
+			}
+		})
+	}
+}
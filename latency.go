@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// abciMethods are the names of the methods of abcitypes.Application.
+var abciMethods = []string{
+	"Info", "Query", "CheckTx", "InitChain", "PrepareProposal", "ProcessProposal", "FinalizeBlock",
+	"ExtendVote", "VerifyVoteExtension", "Commit", "ListSnapshots", "OfferSnapshot",
+	"LoadSnapshotChunk", "ApplySnapshotChunk",
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "150ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(bz []byte) error {
+	var s string
+	if err := json.Unmarshal(bz, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// Distribution is the distribution of the durations of a Delay.
+type Distribution string
+
+const (
+	// DistributionFixed always delays by Duration. It is the distribution of delays without
+	// one.
+	DistributionFixed Distribution = "fixed"
+
+	// DistributionUniform delays by a duration between Min and Max.
+	DistributionUniform Distribution = "uniform"
+
+	// DistributionNormal delays by a duration of mean Duration and standard deviation StdDev,
+	// at least zero.
+	DistributionNormal Distribution = "normal"
+
+	// DistributionExponential delays by a duration of mean Duration.
+	DistributionExponential Distribution = "exponential"
+)
+
+// Delay is the artificial latency added to an ABCI method.
+type Delay struct {
+	Distribution Distribution `json:"distribution"`
+	Duration     Duration     `json:"duration"`
+	Min          Duration     `json:"min"`
+	Max          Duration     `json:"max"`
+	StdDev       Duration     `json:"std_dev"`
+
+	// Heights are the heights of the blocks being decided at which the method is delayed, every
+	// height if there are none.
+	Heights []int64 `json:"heights"`
+}
+
+// parseDelay parses a delay of the form <duration>, <min>-<max>, normal:<mean>,<std dev> or
+// exponential:<mean>, optionally followed by @<height>,<height>...
+func parseDelay(s string) (Delay, error) {
+	var d Delay
+	s, heights, ok := strings.Cut(s, "@")
+	if ok {
+		for _, h := range strings.Split(heights, ",") {
+			height, err := strconv.ParseInt(h, 10, 64)
+			if err != nil {
+				return Delay{}, fmt.Errorf("parsing height: %w", err)
+			}
+			d.Heights = append(d.Heights, height)
+		}
+	}
+
+	var durations []string
+	switch {
+	case strings.HasPrefix(s, "normal:"):
+		d.Distribution = DistributionNormal
+		durations = strings.Split(s[len("normal:"):], ",")
+	case strings.HasPrefix(s, "exponential:"):
+		d.Distribution = DistributionExponential
+		durations = []string{s[len("exponential:"):]}
+	case strings.Contains(s, "-"):
+		d.Distribution = DistributionUniform
+		durations = strings.Split(s, "-")
+	default:
+		d.Distribution = DistributionFixed
+		durations = []string{s}
+	}
+	var parsed []Duration
+	for _, s := range durations {
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return Delay{}, err
+		}
+		parsed = append(parsed, Duration(duration))
+	}
+	switch {
+	case d.Distribution == DistributionUniform && len(parsed) == 2:
+		d.Min, d.Max = parsed[0], parsed[1]
+	case d.Distribution == DistributionNormal && len(parsed) == 2:
+		d.Duration, d.StdDev = parsed[0], parsed[1]
+	case (d.Distribution == DistributionFixed || d.Distribution == DistributionExponential) && len(parsed) == 1:
+		d.Duration = parsed[0]
+	default:
+		return Delay{}, fmt.Errorf("expected <duration>, <min>-<max>, normal:<mean>,<std dev> or exponential:<mean>, got %q", s)
+	}
+	return d, d.validate()
+}
+
+func (d Delay) validate() error {
+	switch d.Distribution {
+	case "", DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential:
+	default:
+		return fmt.Errorf("unknown distribution %q", d.Distribution)
+	}
+	if d.Duration < 0 || d.Min < 0 || d.StdDev < 0 {
+		return fmt.Errorf("negative duration")
+	}
+	if d.Distribution == DistributionUniform && d.Max < d.Min {
+		return fmt.Errorf("maximum %v is below the minimum %v", time.Duration(d.Max), time.Duration(d.Min))
+	}
+	for _, height := range d.Heights {
+		if height <= 0 {
+			return fmt.Errorf("height %d is not positive", height)
+		}
+	}
+	return nil
+}
+
+// sample returns the duration of the delay at height.
+func (d Delay) sample(height int64) time.Duration {
+	if len(d.Heights) != 0 && !slices.Contains(d.Heights, height) {
+		return 0
+	}
+	switch d.Distribution {
+	case DistributionUniform:
+		return time.Duration(d.Min) + time.Duration(rand.Int63n(int64(d.Max-d.Min)+1))
+	case DistributionNormal:
+		return max(0, time.Duration(rand.NormFloat64()*float64(d.StdDev)+float64(d.Duration)))
+	case DistributionExponential:
+		return time.Duration(rand.ExpFloat64() * float64(d.Duration))
+	default:
+		return time.Duration(d.Duration)
+	}
+}
+
+// Latencies are the delays added to ABCI methods, by method name. They can be changed at runtime
+// through the admin server.
+type Latencies map[string]Delay
+
+func (l Latencies) validate() error {
+	for method, delay := range l {
+		if !slices.Contains(abciMethods, method) {
+			return fmt.Errorf("unknown ABCI method %q", method)
+		}
+		if err := delay.validate(); err != nil {
+			return fmt.Errorf("delay of %s: %w", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestParseDelay(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want string // "" if the delay is invalid
+	}{
+		{s: "150ms", want: "{fixed 150ms 0s 0s 0s []}"},
+		{s: "10ms-20ms", want: "{uniform 0s 10ms 20ms 0s []}"},
+		{s: "normal:50ms,10ms", want: "{normal 50ms 0s 0s 10ms []}"},
+		{s: "exponential:30ms", want: "{exponential 30ms 0s 0s 0s []}"},
+		{s: "5ms@3,4", want: "{fixed 5ms 0s 0s 0s [3 4]}"},
+		{s: "1s-1s@2", want: "{uniform 0s 1s 1s 0s [2]}"},
+		{s: "20ms-10ms"},
+		{s: "normal:5ms"},
+		{s: "exponential:5ms,1ms"},
+		{s: "5"},
+		{s: "5ms@0"},
+		{s: "5ms@x"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			d, err := parseDelay(tc.s)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fmt.Sprintf("{%s %v %v %v %v %v}", d.Distribution, time.Duration(d.Duration), time.Duration(d.Min),
+				time.Duration(d.Max), time.Duration(d.StdDev), d.Heights)
+			if got != tc.want {
+				t.Fatalf("parsed %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDelaySample(t *testing.T) {
+	const samples = 10000
+	testCases := []struct {
+		name     string
+		delay    string
+		height   int64
+		min, max time.Duration // the bounds of every sample
+		mean     time.Duration // the mean of the samples, within 10%, if not 0
+	}{
+		{name: "fixed", delay: "15ms", height: 1, min: 15 * time.Millisecond, max: 15 * time.Millisecond},
+		{name: "uniform", delay: "10ms-20ms", height: 1, min: 10 * time.Millisecond, max: 20 * time.Millisecond, mean: 15 * time.Millisecond},
+		{name: "normal", delay: "normal:50ms,10ms", height: 1, min: 0, max: time.Hour, mean: 50 * time.Millisecond},
+		{name: "normal below zero", delay: "normal:1ms,100ms", height: 1, min: 0, max: time.Hour},
+		{name: "exponential", delay: "exponential:30ms", height: 1, min: 0, max: time.Hour, mean: 30 * time.Millisecond},
+		{name: "at a height", delay: "15ms@2,4", height: 4, min: 15 * time.Millisecond, max: 15 * time.Millisecond},
+		{name: "at another height", delay: "15ms@2,4", height: 3, min: 0, max: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := parseDelay(tc.delay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total time.Duration
+			for i := 0; i < samples; i++ {
+				sample := d.sample(tc.height)
+				if sample < tc.min || sample > tc.max {
+					t.Fatalf("sample %v out of [%v, %v]", sample, tc.min, tc.max)
+				}
+				total += sample
+			}
+			if mean := total / samples; tc.mean != 0 && (mean < tc.mean*9/10 || mean > tc.mean*11/10) {
+				t.Fatalf("mean %v, want %v", mean, tc.mean)
+			}
+		})
+	}
+}
+
+func TestLatenciesAdmin(t *testing.T) {
+	app := newTestApp(t, DefaultConfig())
+	initChain(t, app, `{}`)
+	faulty := newFaultyApp(app)
+	const path = "/faults/latency"
+
+	// elapsed returns how long Info takes through the wrapper.
+	elapsed := func() time.Duration {
+		start := time.Now()
+		if _, err := faulty.Info(context.Background(), &abcitypes.InfoRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	putFault(t, app, path, `{"Info": {"duration": "50ms"}}`)
+	if d := elapsed(); d < 50*time.Millisecond {
+		t.Fatalf("Info took %v, want at least 50ms", d)
+	}
+
+	// The height of the block being decided is the one after the last committed block.
+	putFault(t, app, path, `{"Info": {"duration": "50ms", "heights": [2]}}`)
+	if d := elapsed(); d >= 50*time.Millisecond {
+		t.Fatalf("Info took %v at height 1", d)
+	}
+	commitBlock(t, app, 1)
+	if d := elapsed(); d < 50*time.Millisecond {
+		t.Fatalf("Info took %v at height 2, want at least 50ms", d)
+	}
+
+	for _, body := range []string{`{"Unknown": {"duration": "1ms"}}`, `{"Info": {"distribution": "other"}}`, `{"Info": {"duration": "-1ms"}}`, `{"Info": {"duration": 5}}`} {
+		if w := adminRequest(t, app, http.MethodPut, path, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := adminRequest(t, app, http.MethodGet, path, ""); w.Body.String() != `{"Info":{"distribution":"","duration":"50ms","min":"0s","max":"0s","std_dev":"0s","heights":[2]}}`+"\n" {
+		t.Fatalf("GET: %s", w.Body)
+	}
+
+	putFault(t, app, path, `{}`)
+	if d := elapsed(); d >= 50*time.Millisecond {
+		t.Fatalf("Info took %v after the latencies are cleared", d)
+	}
+}
@@ -2,23 +2,130 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	abciserver "github.com/cometbft/cometbft/abci/server"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
 	cmtlog "github.com/cometbft/cometbft/libs/log"
+	"kvstore/crash"
 	db "kvstore/database"
+	"kvstore/snapshot"
 )
 
 var homeDir string
 var socketAddr string
+var metricsAddr string
+var adminAddr string
+var crashPoints []crash.Point
+var config = DefaultConfig()
 
 func init() {
 	flag.StringVar(&homeDir, "home", "", "Path to the kvstore directory (if empty, uses $HOME/.kvstore)")
 	flag.StringVar(&socketAddr, "address", "unix://example.sock", "Unix domain socket address (if empty, uses \"unix://example.sock\"")
+	flag.Uint64Var(&config.SnapshotInterval, "snapshot-interval", config.SnapshotInterval, "Number of heights between state sync snapshots (0 disables snapshots)")
+	flag.IntVar(&config.SnapshotKeepRecent, "snapshot-keep-recent", config.SnapshotKeepRecent, "Number of most recent snapshots to keep")
+	flag.IntVar(&config.SnapshotChunkSize, "snapshot-chunk-size", config.SnapshotChunkSize, "Maximum size of a snapshot chunk in bytes")
+	flag.Int64Var(&config.RetainBlocks, "retain-blocks", config.RetainBlocks, "Number of most recent blocks to keep, older blocks and their state are pruned (0 keeps every block)")
+	flag.BoolVar(&config.RetainFromSnapshot, "retain-from-snapshot", config.RetainFromSnapshot, "Keep the blocks from the height of the latest snapshot, older blocks and their state are pruned")
+	flag.Func("snapshot-format", "Format of the snapshots taken by this node (only format 1 can be restored)", func(s string) error {
+		format, err := strconv.ParseUint(s, 10, 32)
+		config.SnapshotFormat = uint32(format)
+		return err
+	})
+	flag.Func("proposal-strategies", "Comma-separated strategies applied in order to the proposals of this node: max-tx-bytes, priority, drop-invalid, inject, shuffle or reverse (default none)", func(s string) error {
+		config.ProposalStrategies = strings.Split(s, ",")
+		return validateProposalStrategies(config.ProposalStrategies)
+	})
+	flag.StringVar(&metricsAddr, "metrics-address", "", "Address to serve Prometheus metrics on, under /metrics (if empty, metrics are not served)")
+	flag.BoolVar(&config.RejectInvalidTxs, "reject-invalid-txs", config.RejectInvalidTxs, "Reject proposals holding transactions that fail CheckTx")
+	flag.IntVar(&config.MaxProposalTxs, "max-proposal-txs", config.MaxProposalTxs, "Reject proposals with more transactions (0 means no limit)")
+	flag.Int64Var(&config.MaxProposalBytes, "max-proposal-bytes", config.MaxProposalBytes, "Reject proposals whose transactions have more bytes (0 means no limit)")
+	flag.Float64Var(&config.RejectProbability, "reject-probability", config.RejectProbability, "Probability of rejecting a proposal at random")
+	flag.StringVar(&config.RejectProposer, "reject-proposer", config.RejectProposer, "Reject the proposals of the validator with this hex address")
+	flag.Func("lane", "Mempool lane <name>:<priority>[:<key prefix>,...] (repeatable)", func(s string) error {
+		lane, err := parseLane(s)
+		config.Lanes = append(config.Lanes, lane)
+		return err
+	})
+	flag.StringVar(&config.DefaultLane, "default-lane", config.DefaultLane, "Mempool lane of the transactions assigned to no other lane")
+	flag.StringVar(&adminAddr, "admin-address", "", "Address to serve the admin endpoints changing faults at runtime on (if empty, they are not served)")
+	flag.IntVar(&config.VoteExtensionFaults.OversizedSize, "oversized-vote-extensions", 0, "Pad the vote extensions of this node to this size in bytes (0 disables it)")
+	flag.BoolVar(&config.VoteExtensionFaults.Random, "random-vote-extensions", false, "Extend the votes of this node with random bytes")
+	flag.Func("reject-vote-extensions-from", "Comma-separated hex addresses of the validators whose vote extensions are rejected", func(s string) error {
+		config.VoteExtensionFaults.RejectValidators = strings.Split(s, ",")
+		return config.VoteExtensionFaults.validate()
+	})
+	flag.Func("reject-vote-extensions-at", "Comma-separated heights at which every vote extension is rejected", func(s string) error {
+		for _, h := range strings.Split(s, ",") {
+			height, err := strconv.ParseInt(h, 10, 64)
+			if err != nil {
+				return err
+			}
+			config.VoteExtensionFaults.RejectHeights = append(config.VoteExtensionFaults.RejectHeights, height)
+		}
+		return config.VoteExtensionFaults.validate()
+	})
+	flag.Func("non-determinism", "Execute blocks differently than the other nodes: value, app-hash or tx-results", func(s string) error {
+		mode, err := parseNonDeterminismMode(s)
+		config.NonDeterminism.Mode = mode
+		return err
+	})
+	flag.Func("non-determinism-heights", "Comma-separated heights at which --non-determinism applies (default every height)", func(s string) error {
+		for _, h := range strings.Split(s, ",") {
+			height, err := strconv.ParseInt(h, 10, 64)
+			if err != nil {
+				return err
+			}
+			config.NonDeterminism.Heights = append(config.NonDeterminism.Heights, height)
+		}
+		return config.NonDeterminism.validate()
+	})
+	flag.Func("latency", "Delay of an ABCI method <method>=<delay>, where delay is <duration>, <min>-<max>, normal:<mean>,<std dev> or exponential:<mean>, optionally followed by @<height>,... (repeatable)", func(s string) error {
+		method, spec, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected <method>=<delay>")
+		}
+		delay, err := parseDelay(spec)
+		if err != nil {
+			return err
+		}
+		if config.Latencies == nil {
+			config.Latencies = Latencies{}
+		}
+		config.Latencies[method] = delay
+		return config.Latencies.validate()
+	})
+	flag.Func("abci-fault", "Fault of an ABCI method <method>=<error|panic>[:<probability>][@<height>,...] (repeatable)", func(s string) error {
+		method, spec, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected <method>=<fault>")
+		}
+		fault, err := parseMethodFault(spec)
+		if err != nil {
+			return err
+		}
+		if config.MethodFaults == nil {
+			config.MethodFaults = MethodFaults{}
+		}
+		config.MethodFaults[method] = fault
+		return config.MethodFaults.validate()
+	})
+	flag.Func("crash-point", "Exit at the crash point <name>[:<height>[:<hit>]], at any height if height is 0, after it is hit <hit> times (default 1) (repeatable)", func(s string) error {
+		p, err := crash.ParsePoint(s)
+		crashPoints = append(crashPoints, p)
+		return err
+	})
+	flag.Func("snapshot-fault", "Take or serve faulty snapshots: bad-chunk-hash, truncated-chunk or app-hash-mismatch", func(s string) error {
+		fault, err := snapshot.ParseFault(s)
+		config.SnapshotFault = fault
+		return err
+	})
 }
 
 func main() {
@@ -30,6 +137,20 @@ func main() {
 	if homeDir == "" {
 		homeDir = os.ExpandEnv(defaultHomeDir)
 	}
+	envPoints, err := crash.ParseEnv()
+	if err != nil {
+		log.Fatalf("Arming crash points: %v", err)
+	}
+	if err := os.MkdirAll(homeDir, 0o755); err != nil {
+		log.Fatalf("Creating home directory: %v", err)
+	}
+	if err := crash.Arm(append(crashPoints, envPoints...), filepath.Join(homeDir, "crash_points_fired")); err != nil {
+		log.Fatalf("Arming crash points: %v", err)
+	}
+	for _, p := range crash.Armed() {
+		logger.Info("crash point armed", "name", p.Name, "height", p.Height, "hit", p.Hit)
+	}
+
 	dbPath := filepath.Join(homeDir, "data")
 	db, err := db.NewPebbleDB("kvstore++", dbPath)
 	if err != nil {
@@ -43,9 +164,39 @@ func main() {
 		}
 	}()
 
-	app := NewKVStoreApplication(db, logger)
+	snapshotPath := filepath.Join(homeDir, "snapshots")
+	snapshots, err := snapshot.NewStore(snapshotPath)
+	if err != nil {
+		log.Fatalf("Opening snapshot store: %v", err)
+	}
+
+	app, err := NewKVStoreApplication(db, snapshots, config, logger)
+	if err != nil {
+		log.Fatalf("Loading application state: %v", err)
+	}
+	logger.Info("application state loaded", "height", app.state.Height, "app_hash", fmt.Sprintf("%X", app.state.AppHash))
+	for _, lane := range app.cfg.Lanes {
+		logger.Info("mempool lane", "name", lane.Name, "priority", lane.Priority, "key_prefixes", lane.KeyPrefixes, "default", lane.Name == app.cfg.DefaultLane)
+	}
+
+	if metricsAddr != "" {
+		go func() {
+			if err := serveMetrics(metricsAddr); err != nil {
+				logger.Error("metrics", "msg", "error serving metrics", "err", err)
+			}
+		}()
+		logger.Info("serving metrics", "address", metricsAddr)
+	}
+	if adminAddr != "" {
+		go func() {
+			if err := serveAdmin(adminAddr, app); err != nil {
+				logger.Error("admin", "msg", "error serving admin endpoints", "err", err)
+			}
+		}()
+		logger.Info("serving admin endpoints", "address", adminAddr)
+	}
 
-	server := abciserver.NewSocketServer(socketAddr, app)
+	server := abciserver.NewSocketServer(socketAddr, newFaultyApp(app))
 	server.SetLogger(logger)
 
 	if err := server.Start(); err != nil {
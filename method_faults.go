@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MethodFaultKind is the way an ABCI method fails, see MethodFault.
+type MethodFaultKind string
+
+const (
+	// MethodFaultError makes the method return an error, without calling the application.
+	MethodFaultError MethodFaultKind = "error"
+
+	// MethodFaultPanic makes the method panic, without calling the application.
+	MethodFaultPanic MethodFaultKind = "panic"
+)
+
+// MethodFault makes an ABCI method fail, to test how CometBFT reacts to application errors.
+type MethodFault struct {
+	Kind MethodFaultKind `json:"kind"`
+
+	// Heights are the heights of the blocks being decided at which the method fails, every
+	// height if there are none.
+	Heights []int64 `json:"heights"`
+
+	// Probability is the probability that the method fails at these heights, from 0 (never) to
+	// 1 (always). It is required, parseMethodFault defaults it to 1.
+	Probability *float64 `json:"probability"`
+}
+
+// parseMethodFault parses a fault of the form <kind>[:<probability>][@<height>,<height>...].
+func parseMethodFault(s string) (MethodFault, error) {
+	var f MethodFault
+	s, heights, ok := strings.Cut(s, "@")
+	if ok {
+		for _, h := range strings.Split(heights, ",") {
+			height, err := strconv.ParseInt(h, 10, 64)
+			if err != nil {
+				return MethodFault{}, fmt.Errorf("parsing height: %w", err)
+			}
+			f.Heights = append(f.Heights, height)
+		}
+	}
+	kind, probability, ok := strings.Cut(s, ":")
+	f.Kind = MethodFaultKind(kind)
+	p := 1.0
+	if ok {
+		var err error
+		if p, err = strconv.ParseFloat(probability, 64); err != nil {
+			return MethodFault{}, fmt.Errorf("parsing probability: %w", err)
+		}
+	}
+	f.Probability = &p
+	return f, f.validate()
+}
+
+func (f MethodFault) validate() error {
+	if f.Kind != MethodFaultError && f.Kind != MethodFaultPanic {
+		return fmt.Errorf("unknown fault %q, expected %s or %s", f.Kind, MethodFaultError, MethodFaultPanic)
+	}
+	if f.Probability == nil {
+		return errors.New("missing probability")
+	}
+	if *f.Probability < 0 || *f.Probability > 1 {
+		return fmt.Errorf("probability %v is not between 0 and 1", *f.Probability)
+	}
+	for _, height := range f.Heights {
+		if height <= 0 {
+			return fmt.Errorf("height %d is not positive", height)
+		}
+	}
+	return nil
+}
+
+// trigger returns whether the method fails at height.
+func (f MethodFault) trigger(height int64) bool {
+	if len(f.Heights) != 0 && !slices.Contains(f.Heights, height) {
+		return false
+	}
+	return f.Probability != nil && rand.Float64() < *f.Probability
+}
+
+// MethodFaults are the faults of ABCI methods, by method name. They can be changed at runtime
+// through the admin server.
+type MethodFaults map[string]MethodFault
+
+func (m MethodFaults) validate() error {
+	for method, fault := range m {
+		if !slices.Contains(abciMethods, method) {
+			return fmt.Errorf("unknown ABCI method %q", method)
+		}
+		if err := fault.validate(); err != nil {
+			return fmt.Errorf("fault of %s: %w", method, err)
+		}
+	}
+	return nil
+}
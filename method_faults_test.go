@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestParseMethodFault(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want string // "" if the fault is invalid
+	}{
+		{s: "error", want: "error 1 []"},
+		{s: "panic:0.25", want: "panic 0.25 []"},
+		{s: "error@2,5", want: "error 1 [2 5]"},
+		{s: "panic:0@3", want: "panic 0 [3]"},
+		{s: "crash"},
+		{s: "error:1.5"},
+		{s: "error:x"},
+		{s: "error@0"},
+		{s: "error@x"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			f, err := parseMethodFault(tc.s)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", f)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%s %v %v", f.Kind, *f.Probability, f.Heights); got != tc.want {
+				t.Fatalf("parsed %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// callInfo calls Info through the wrapper, returning its error or the error it panics with.
+func callInfo(a *faultyApp) (resp *abcitypes.InfoResponse, err error, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, panicked = r.(error), true
+		}
+	}()
+	resp, err = a.Info(context.Background(), &abcitypes.InfoRequest{})
+	return resp, err, false
+}
+
+func TestFaultyApp(t *testing.T) {
+	testCases := []struct {
+		name   string
+		faults string // the method faults, in JSON
+		err    bool
+		panics bool
+	}{
+		{name: "none", faults: `{}`},
+		{name: "error", faults: `{"Info": {"kind": "error", "probability": 1}}`, err: true},
+		{name: "panic", faults: `{"Info": {"kind": "panic", "probability": 1}}`, panics: true},
+		{name: "at the height", faults: `{"Info": {"kind": "error", "heights": [1, 2], "probability": 1}}`, err: true},
+		{name: "at another height", faults: `{"Info": {"kind": "panic", "heights": [2], "probability": 1}}`},
+		{name: "never", faults: `{"Info": {"kind": "panic", "probability": 0}}`},
+		{name: "another method", faults: `{"Query": {"kind": "panic", "probability": 1}}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, `{}`)
+			putFault(t, app, "/faults/abci", tc.faults)
+
+			resp, err, panicked := callInfo(newFaultyApp(app))
+			if panicked != tc.panics {
+				t.Fatalf("panicked %v, want %v", panicked, tc.panics)
+			}
+			if tc.err || tc.panics {
+				if err == nil || !strings.Contains(err.Error(), "in Info at height 1") {
+					t.Fatalf("expected an injected error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.LastBlockHeight != 0 {
+				t.Fatalf("last block height %d, want 0", resp.LastBlockHeight)
+			}
+		})
+	}
+}
+
+func TestFaultyAppProbability(t *testing.T) {
+	const calls = 1000
+	app := newTestApp(t, DefaultConfig())
+	initChain(t, app, `{}`)
+	putFault(t, app, "/faults/abci", `{"Info": {"kind": "error", "probability": 0.5}}`)
+	faulty := newFaultyApp(app)
+
+	failed := 0
+	for i := 0; i < calls; i++ {
+		if _, err, _ := callInfo(faulty); err != nil {
+			failed++
+		}
+	}
+	if failed < calls*4/10 || failed > calls*6/10 {
+		t.Fatalf("%d of %d calls failed with probability 0.5", failed, calls)
+	}
+}
+
+func TestMethodFaultsAdmin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MethodFaults = MethodFaults{"Info": {Kind: MethodFaultError, Probability: new(float64)}}
+	app := newTestApp(t, cfg)
+	const path = "/faults/abci"
+
+	if w := adminRequest(t, app, http.MethodGet, path, ""); w.Body.String() != `{"Info":{"kind":"error","heights":null,"probability":0}}`+"\n" {
+		t.Fatalf("GET: %s", w.Body)
+	}
+	for _, body := range []string{
+		`{"Unknown": {"kind": "error", "probability": 1}}`,
+		`{"Info": {"kind": "crash", "probability": 1}}`,
+		`{"Info": {"kind": "error"}}`,
+		`{"Info": {"kind": "error", "probability": 2}}`,
+		`{"Info": {"kind": "error", "probability": 1, "heights": [0]}}`,
+	} {
+		if w := adminRequest(t, app, http.MethodPut, path, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if _, err, _ := callInfo(newFaultyApp(app)); err != nil {
+		t.Fatalf("invalid faults changed the faults: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kvstore"
+
+// processedProposals counts the proposals processed by this node, by status and by the reason
+// they were rejected for.
+var processedProposals = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "processed_proposals_total",
+	Help:      "Number of proposals processed, by status and rejection reason.",
+}, []string{"status", "reason"})
+
+// serveMetrics serves the metrics in the Prometheus format on addr, under /metrics.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
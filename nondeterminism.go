@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// nonDeterministicKey is the key written with a random value by the value non-determinism mode.
+var nonDeterministicKey = []byte("_nondeterministic")
+
+// NonDeterminismMode is the way a node diverges from the other nodes, see NonDeterminism.
+type NonDeterminismMode string
+
+const (
+	// NonDeterminismNone executes blocks like the other nodes.
+	NonDeterminismNone NonDeterminismMode = ""
+
+	// NonDeterminismValue writes a random value in the state, so the app hash and every following
+	// app hash diverge.
+	NonDeterminismValue NonDeterminismMode = "value"
+
+	// NonDeterminismAppHash returns an altered app hash from FinalizeBlock, while the state and
+	// the following app hashes are the same as on the other nodes.
+	NonDeterminismAppHash NonDeterminismMode = "app-hash"
+
+	// NonDeterminismTxResults swaps the codes of the transaction results, a zero code becomes
+	// codeTypeInternalError and the others zero, so the results hash diverges if the block has
+	// transactions.
+	NonDeterminismTxResults NonDeterminismMode = "tx-results"
+)
+
+func parseNonDeterminismMode(s string) (NonDeterminismMode, error) {
+	switch m := NonDeterminismMode(s); m {
+	case NonDeterminismNone, NonDeterminismValue, NonDeterminismAppHash, NonDeterminismTxResults:
+		return m, nil
+	default:
+		return NonDeterminismNone, fmt.Errorf("unknown non-determinism mode %q", s)
+	}
+}
+
+// NonDeterminism makes this node execute blocks differently than the other nodes at some
+// heights, to test how CometBFT reacts to diverging validators. It can be changed at runtime
+// through the admin server.
+type NonDeterminism struct {
+	Mode NonDeterminismMode `json:"mode"`
+
+	// Heights are the heights the mode applies at, every height if there are none.
+	Heights []int64 `json:"heights"`
+}
+
+func (n NonDeterminism) validate() error {
+	if _, err := parseNonDeterminismMode(string(n.Mode)); err != nil {
+		return err
+	}
+	for _, height := range n.Heights {
+		if height <= 0 {
+			return fmt.Errorf("height %d is not positive", height)
+		}
+	}
+	return nil
+}
+
+// at returns the mode at height.
+func (n NonDeterminism) at(height int64) NonDeterminismMode {
+	if len(n.Heights) != 0 && !slices.Contains(n.Heights, height) {
+		return NonDeterminismNone
+	}
+	return n.Mode
+}
+
+// writeRandomValue writes a random value under nonDeterministicKey with w.
+func writeRandomValue(w *stateWriter) error {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return err
+	}
+	return w.Set(nonDeterministicKey, value)
+}
+
+// alteredAppHash returns a copy of appHash with its bits flipped.
+func alteredAppHash(appHash []byte) []byte {
+	altered := make([]byte, len(appHash))
+	for i, b := range appHash {
+		altered[i] = ^b
+	}
+	return altered
+}
+
+// swapResultCodes swaps the codes of the results, see NonDeterminismTxResults.
+func swapResultCodes(results []*abcitypes.ExecTxResult) {
+	for _, result := range results {
+		if result.Code == codeTypeOK {
+			result.Code = codeTypeInternalError
+			result.Codespace = codespace
+		} else {
+			result.Code = codeTypeOK
+			result.Codespace = ""
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+func TestNonDeterminism(t *testing.T) {
+	testCases := []struct {
+		mode     NonDeterminismMode
+		appHash  string // the heights the app hash returned by FinalizeBlock differs at
+		state    string // the heights the committed state differs at
+		txResult string // the heights the results of the transactions differ at
+	}{
+		{mode: NonDeterminismNone, appHash: "[]", state: "[]", txResult: "[]"},
+		{mode: NonDeterminismValue, appHash: "[2 3]", state: "[2 3]", txResult: "[]"},
+		{mode: NonDeterminismAppHash, appHash: "[2]", state: "[]", txResult: "[]"},
+		{mode: NonDeterminismTxResults, appHash: "[]", state: "[]", txResult: "[2]"},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			honest := newTestApp(t, DefaultConfig())
+			initChain(t, honest, `{}`)
+			cfg := DefaultConfig()
+			cfg.NonDeterminism = NonDeterminism{Mode: tc.mode, Heights: []int64{2}}
+			faulty := newTestApp(t, cfg)
+			initChain(t, faulty, `{}`)
+
+			var appHash, state, txResult []int64
+			for height := int64(1); height <= 3; height++ {
+				txs := []string{fmt.Sprintf("k=%d", height), "cas:k=x=y"}
+				honestResp, faultyResp := finalizeBlock(t, honest, height, txs...), finalizeBlock(t, faulty, height, txs...)
+				for _, app := range []*KVStoreApplication{honest, faulty} {
+					if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !bytes.Equal(honestResp.AppHash, faultyResp.AppHash) {
+					appHash = append(appHash, height)
+				}
+				if !bytes.Equal(honest.state.AppHash, faulty.state.AppHash) {
+					state = append(state, height)
+				}
+				for i := range txs {
+					if honestResp.TxResults[i].Code != faultyResp.TxResults[i].Code {
+						txResult = append(txResult, height)
+						break
+					}
+				}
+			}
+			if fmt.Sprint(appHash) != tc.appHash || fmt.Sprint(state) != tc.state || fmt.Sprint(txResult) != tc.txResult {
+				t.Fatalf("app hash differs at %v, state at %v, tx results at %v, want %s, %s and %s",
+					appHash, state, txResult, tc.appHash, tc.state, tc.txResult)
+			}
+
+			value, err := faulty.store.Get(nonDeterministicKey, db.LatestVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (value != nil) != (tc.mode == NonDeterminismValue) {
+				t.Fatalf("non-deterministic value %X", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+const (
+	// deleteTxPrefix starts the transactions deleting a key, of the form del:<key>.
+	deleteTxPrefix = "del:"
+
+	// casTxPrefix starts the compare-and-swap transactions, of the form
+	// cas:<key>=<expected>=<value>. They set key to value if its current value is expected, a
+	// missing key matches an empty expected value.
+	casTxPrefix = "cas:"
+
+	// incrementTxPrefix starts the transactions adding to an integer value, of the form
+	// inc:<key>=<delta>. A missing key counts as 0.
+	incrementTxPrefix = "inc:"
+
+	// multiTxPrefix starts the transactions applying several operations atomically, of the form
+	// multi:<op>;<op>... where every op is a set, delete, compare-and-swap or increment.
+	multiTxPrefix = "multi:"
+)
+
+type opKind int
+
+const (
+	opSet opKind = iota
+	opDelete
+	opCompareAndSwap
+	opIncrement
+)
+
+// op is a change to a single key.
+type op struct {
+	kind     opKind
+	key      []byte
+	value    []byte
+	expected []byte
+	delta    int64
+}
+
+// opError is the failure of an op at execution, such as a compare-and-swap whose expected
+// value does not match. It fails the transaction with code.
+type opError struct {
+	code uint32
+	msg  string
+}
+
+func (e *opError) Error() string {
+	return e.msg
+}
+
+// parseOps parses a transaction changing key/value pairs.
+func parseOps(tx []byte) ([]op, error) {
+	if !bytes.HasPrefix(tx, []byte(multiTxPrefix)) {
+		o, err := parseOp(tx)
+		if err != nil {
+			return nil, err
+		}
+		return []op{o}, nil
+	}
+
+	var ops []op
+	for _, s := range bytes.Split(tx[len(multiTxPrefix):], []byte(";")) {
+		o, err := parseOp(s)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+func parseOp(s []byte) (op, error) {
+	var o op
+	switch {
+	case bytes.HasPrefix(s, []byte(deleteTxPrefix)):
+		o = op{kind: opDelete, key: s[len(deleteTxPrefix):]}
+	case bytes.HasPrefix(s, []byte(casTxPrefix)):
+		parts := bytes.Split(s[len(casTxPrefix):], []byte("="))
+		if len(parts) != 3 {
+			return op{}, errors.New("expected cas:<key>=<expected>=<value>")
+		}
+		o = op{kind: opCompareAndSwap, key: parts[0], expected: parts[1], value: parts[2]}
+	case bytes.HasPrefix(s, []byte(incrementTxPrefix)):
+		parts := bytes.Split(s[len(incrementTxPrefix):], []byte("="))
+		if len(parts) != 2 {
+			return op{}, errors.New("expected inc:<key>=<delta>")
+		}
+		delta, err := strconv.ParseInt(string(parts[1]), 10, 64)
+		if err != nil {
+			return op{}, fmt.Errorf("parsing delta: %w", err)
+		}
+		o = op{kind: opIncrement, key: parts[0], delta: delta}
+	default:
+		parts := bytes.Split(s, []byte("="))
+		if len(parts) != 2 {
+			return op{}, errors.New("expected <key>=<value>")
+		}
+		o = op{kind: opSet, key: parts[0], value: parts[1]}
+	}
+	if len(o.key) == 0 {
+		return op{}, errors.New("empty key")
+	}
+	return o, nil
+}
+
+// kvWriter receives the writes of an opBatch when it is flushed.
+type kvWriter interface {
+	Set(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// opBatch stages writes on top of the state read with get. It stages the writes of a
+// transaction, so that they are only applied if all its ops succeed, and ops read the writes of
+// the previous ops of the transaction. It also holds the check state, see checkState.
+type opBatch struct {
+	get    func(key []byte) ([]byte, error)
+	writes map[string][]byte
+	keys   [][]byte
+}
+
+func newOpBatch(get func(key []byte) ([]byte, error)) *opBatch {
+	return &opBatch{get: get, writes: map[string][]byte{}}
+}
+
+func (b *opBatch) read(key []byte) ([]byte, error) {
+	if value, ok := b.writes[string(key)]; ok {
+		return value, nil
+	}
+	return b.get(key)
+}
+
+// write stages a write of key, a nil value deletes it.
+func (b *opBatch) write(key, value []byte) {
+	if _, ok := b.writes[string(key)]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.writes[string(key)] = value
+}
+
+func (b *opBatch) Set(key, value []byte) error {
+	b.write(key, value)
+	return nil
+}
+
+func (b *opBatch) Delete(key []byte) error {
+	b.write(key, nil)
+	return nil
+}
+
+// apply stages the op and returns its event.
+func (b *opBatch) apply(o op) (abcitypes.Event, error) {
+	switch o.kind {
+	case opDelete:
+		b.write(o.key, nil)
+		return opEvent("delete", o.key, nil), nil
+
+	case opCompareAndSwap:
+		current, err := b.read(o.key)
+		if err != nil {
+			return abcitypes.Event{}, err
+		}
+		if !bytes.Equal(current, o.expected) {
+			return abcitypes.Event{}, &opError{codeTypeCompareFailed, fmt.Sprintf("value of %q does not match the expected value", o.key)}
+		}
+		b.write(o.key, o.value)
+		return opEvent("compare_and_swap", o.key, o.value), nil
+
+	case opIncrement:
+		current, err := b.read(o.key)
+		if err != nil {
+			return abcitypes.Event{}, err
+		}
+		var n int64
+		if current != nil {
+			if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return abcitypes.Event{}, &opError{codeTypeInvalidValue, fmt.Sprintf("value of %q is not an integer", o.key)}
+			}
+		}
+		if o.delta > 0 && n > math.MaxInt64-o.delta || o.delta < 0 && n < math.MinInt64-o.delta {
+			return abcitypes.Event{}, &opError{codeTypeInvalidValue, fmt.Sprintf("incrementing %q overflows", o.key)}
+		}
+		value := []byte(strconv.FormatInt(n+o.delta, 10))
+		b.write(o.key, value)
+		return opEvent("increment", o.key, value), nil
+
+	default:
+		b.write(o.key, o.value)
+		return opEvent("event", o.key, o.value), nil
+	}
+}
+
+// flush applies the staged writes with w.
+func (b *opBatch) flush(w kvWriter) error {
+	for _, key := range b.keys {
+		value := b.writes[string(key)]
+		if value == nil {
+			if err := w.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// opEvent returns the event of an op on key, with the value it wrote if any.
+func opEvent(typ string, key, value []byte) abcitypes.Event {
+	attrs := []abcitypes.EventAttribute{{Key: "key", Value: string(key), Index: true}}
+	if value != nil {
+		attrs = append(attrs, abcitypes.EventAttribute{Key: "value", Value: string(value), Index: true})
+	}
+	return abcitypes.Event{Type: typ, Attributes: attrs}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+func TestParseOps(t *testing.T) {
+	testCases := []struct {
+		tx   string
+		want []op // nil if the transaction is invalid
+	}{
+		{tx: "k=v", want: []op{{kind: opSet, key: []byte("k"), value: []byte("v")}}},
+		{tx: "k=", want: []op{{kind: opSet, key: []byte("k"), value: []byte{}}}},
+		{tx: "del:k", want: []op{{kind: opDelete, key: []byte("k")}}},
+		{tx: "cas:k=a=b", want: []op{{kind: opCompareAndSwap, key: []byte("k"), expected: []byte("a"), value: []byte("b")}}},
+		{tx: "cas:k==b", want: []op{{kind: opCompareAndSwap, key: []byte("k"), expected: []byte{}, value: []byte("b")}}},
+		{tx: "inc:k=-5", want: []op{{kind: opIncrement, key: []byte("k"), delta: -5}}},
+		{tx: "multi:a=1;del:b;inc:c=2", want: []op{
+			{kind: opSet, key: []byte("a"), value: []byte("1")},
+			{kind: opDelete, key: []byte("b")},
+			{kind: opIncrement, key: []byte("c"), delta: 2},
+		}},
+		{tx: "k"},
+		{tx: "k=v=w"},
+		{tx: "=v"},
+		{tx: "del:"},
+		{tx: "cas:k=a"},
+		{tx: "cas:=a=b"},
+		{tx: "inc:k"},
+		{tx: "inc:k=x"},
+		{tx: "inc:k=9223372036854775808"},
+		{tx: "multi:"},
+		{tx: "multi:a=1;b"},
+		{tx: "multi:a=1;"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.tx, func(t *testing.T) {
+			ops, err := parseOps([]byte(tc.tx))
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", ops)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(ops) != fmt.Sprint(tc.want) {
+				t.Fatalf("parsed %+v, want %+v", ops, tc.want)
+			}
+		})
+	}
+}
+
+// userKVs returns the key/value pairs written by transactions at the latest height.
+func userKVs(t *testing.T, app *KVStoreApplication) string {
+	t.Helper()
+	var kvs []string
+	for key, value := range storeContents(t, app, db.LatestVersion) {
+		if !strings.HasPrefix(key, string(reservedPrefix)) {
+			kvs = append(kvs, key+"="+value)
+		}
+	}
+	sort.Strings(kvs)
+	return fmt.Sprint(kvs)
+}
+
+func TestExecOps(t *testing.T) {
+	const genesis = `{"kvs": {"a": "1", "empty": "", "n": "41", "text": "x", "max": "9223372036854775807", "min": "-9223372036854775808"}}`
+	const unchanged = "[a=1 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"
+
+	testCases := []struct {
+		name string
+		tx   string
+		code uint32
+		kvs  string // the key/value pairs after the transaction
+	}{
+		{name: "set", tx: "b=2", kvs: "[a=1 b=2 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "delete", tx: "del:a", kvs: "[empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "delete of a missing key", tx: "del:missing", kvs: unchanged},
+		{name: "cas", tx: "cas:a=1=2", kvs: "[a=2 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "cas mismatch", tx: "cas:a=2=3", code: codeTypeCompareFailed, kvs: unchanged},
+		{name: "cas of a missing key", tx: "cas:b==2", kvs: "[a=1 b=2 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "cas of a missing key with a value", tx: "cas:b=1=2", code: codeTypeCompareFailed, kvs: unchanged},
+		{name: "cas of a present key without a value", tx: "cas:a==2", code: codeTypeCompareFailed, kvs: unchanged},
+		{name: "cas of an empty value", tx: "cas:empty==2", kvs: "[a=1 empty=2 max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "cas of an empty value with a value", tx: "cas:empty=1=2", code: codeTypeCompareFailed, kvs: unchanged},
+		{name: "increment", tx: "inc:n=1", kvs: "[a=1 empty= max=9223372036854775807 min=-9223372036854775808 n=42 text=x]"},
+		{name: "increment of a missing key", tx: "inc:b=-3", kvs: "[a=1 b=-3 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "increment of a text", tx: "inc:text=1", code: codeTypeInvalidValue, kvs: unchanged},
+		{name: "increment of an empty value", tx: "inc:empty=1", code: codeTypeInvalidValue, kvs: unchanged},
+		{name: "increment overflow", tx: "inc:max=1", code: codeTypeInvalidValue, kvs: unchanged},
+		{name: "decrement overflow", tx: "inc:min=-1", code: codeTypeInvalidValue, kvs: unchanged},
+		{name: "increment to the maximum", tx: "inc:n=9223372036854775766", kvs: "[a=1 empty= max=9223372036854775807 min=-9223372036854775808 n=9223372036854775807 text=x]"},
+		{name: "multi", tx: "multi:a=5;del:text;inc:n=1", kvs: "[a=5 empty= max=9223372036854775807 min=-9223372036854775808 n=42]"},
+		{name: "multi reading its writes", tx: "multi:b=1;cas:b=1=2;inc:b=1", kvs: "[a=1 b=3 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "multi deleting then comparing", tx: "multi:del:a;cas:a==2", kvs: "[a=2 empty= max=9223372036854775807 min=-9223372036854775808 n=41 text=x]"},
+		{name: "multi failing on its last op", tx: "multi:a=5;del:n;cas:text=y=z", code: codeTypeCompareFailed, kvs: unchanged},
+		{name: "multi failing on an overflow", tx: "multi:a=5;inc:max=1", code: codeTypeInvalidValue, kvs: unchanged},
+		{name: "multi with a reserved key", tx: "multi:a=5;_val/x=1", code: codeTypeReservedKey, kvs: unchanged},
+		{name: "invalid format", tx: "multi:a=5;b", code: codeTypeInvalidTxFormat, kvs: unchanged},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, genesis)
+
+			check, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tc.tx), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.Code != tc.code {
+				t.Fatalf("CheckTx code %d (%s), want %d", check.Code, check.Log, tc.code)
+			}
+			results := commitBlock(t, app, 1, tc.tx)
+			if results[0].Code != tc.code {
+				t.Fatalf("FinalizeBlock code %d (%s), want %d", results[0].Code, results[0].Log, tc.code)
+			}
+			if kvs := userKVs(t, app); kvs != tc.kvs {
+				t.Fatalf("store %s, want %s", kvs, tc.kvs)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
+
+	db "kvstore/database"
+)
+
+// paramsTxPrefix starts the transactions that update the consensus parameters. They have the
+// form params:<name>=<value>[,<name>=<value>...], see paramSetters for the names.
+const paramsTxPrefix = "params:"
+
+// paramsKey is the key under which the consensus parameters are stored.
+var paramsKey = []byte("_params")
+
+// paramSetters set a consensus parameter from its value in a transaction. The part of the name
+// before the dot is the group of the parameter in the consensus parameters.
+var paramSetters = map[string]func(p *cmttypes.ConsensusParams, value string) error{
+	"block.max_bytes":                       intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Block.MaxBytes }),
+	"block.max_gas":                         intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Block.MaxGas }),
+	"evidence.max_age_num_blocks":           intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Evidence.MaxAgeNumBlocks }),
+	"evidence.max_age_duration":             durationParam(func(p *cmttypes.ConsensusParams) *time.Duration { return &p.Evidence.MaxAgeDuration }),
+	"evidence.max_bytes":                    intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Evidence.MaxBytes }),
+	"feature.vote_extensions_enable_height": intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Feature.VoteExtensionsEnableHeight }),
+	"feature.pbts_enable_height":            intParam(func(p *cmttypes.ConsensusParams) *int64 { return &p.Feature.PbtsEnableHeight }),
+	"synchrony.precision":                   durationParam(func(p *cmttypes.ConsensusParams) *time.Duration { return &p.Synchrony.Precision }),
+	"synchrony.message_delay":               durationParam(func(p *cmttypes.ConsensusParams) *time.Duration { return &p.Synchrony.MessageDelay }),
+}
+
+func intParam(field func(p *cmttypes.ConsensusParams) *int64) func(*cmttypes.ConsensusParams, string) error {
+	return func(p *cmttypes.ConsensusParams, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		*field(p) = n
+		return err
+	}
+}
+
+func durationParam(field func(p *cmttypes.ConsensusParams) *time.Duration) func(*cmttypes.ConsensusParams, string) error {
+	return func(p *cmttypes.ConsensusParams, value string) error {
+		d, err := time.ParseDuration(value)
+		*field(p) = d
+		return err
+	}
+}
+
+type paramChange struct {
+	name, value string
+}
+
+func isParamsTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(paramsTxPrefix))
+}
+
+func parseParamsTx(tx []byte) ([]paramChange, error) {
+	var changes []paramChange
+	for _, pair := range strings.Split(string(tx[len(paramsTxPrefix):]), ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <name>=<value>, got %q", pair)
+		}
+		change, err := newParamChange(name, value)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func newParamChange(name, value string) (paramChange, error) {
+	setter, ok := paramSetters[name]
+	if !ok {
+		return paramChange{}, fmt.Errorf("unknown consensus parameter %q", name)
+	}
+	if err := setter(&cmttypes.ConsensusParams{}, value); err != nil {
+		return paramChange{}, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return paramChange{name: name, value: value}, nil
+}
+
+// setParams applies the changes to params and adds the groups they belong to to groups.
+func setParams(params *cmttypes.ConsensusParams, changes []paramChange, groups map[string]bool) error {
+	for _, change := range changes {
+		if err := paramSetters[change.name](params, change.value); err != nil {
+			return err
+		}
+		group, _, _ := strings.Cut(change.name, ".")
+		groups[group] = true
+	}
+	return nil
+}
+
+// paramsUpdate accumulates the consensus parameter changes of a block.
+type paramsUpdate struct {
+	current cmttypes.ConsensusParams
+	next    cmttypes.ConsensusParams
+	groups  map[string]bool
+}
+
+func newParamsUpdate(current *cmtproto.ConsensusParams) *paramsUpdate {
+	params := cmttypes.ConsensusParamsFromProto(*current)
+	return &paramsUpdate{current: params, next: params, groups: map[string]bool{}}
+}
+
+// apply applies the changes on top of the previous ones if the result is a valid update of the
+// current parameters at height.
+func (u *paramsUpdate) apply(changes []paramChange, height int64) error {
+	next := u.next
+	groups := map[string]bool{}
+	for group := range u.groups {
+		groups[group] = true
+	}
+	if err := setParams(&next, changes, groups); err != nil {
+		return err
+	}
+	if err := next.ValidateBasic(); err != nil {
+		return err
+	}
+	if err := u.current.ValidateUpdate(protoUpdate(next, groups), height); err != nil {
+		return err
+	}
+	u.next, u.groups = next, groups
+	return nil
+}
+
+// proto returns the update to send to CometBFT, or nil if there were no changes.
+func (u *paramsUpdate) proto() *cmtproto.ConsensusParams {
+	if len(u.groups) == 0 {
+		return nil
+	}
+	return protoUpdate(u.next, u.groups)
+}
+
+// protoUpdate returns an update holding the given groups of params.
+func protoUpdate(params cmttypes.ConsensusParams, groups map[string]bool) *cmtproto.ConsensusParams {
+	full := params.ToProto()
+	update := &cmtproto.ConsensusParams{}
+	if groups["block"] {
+		update.Block = full.Block
+	}
+	if groups["evidence"] {
+		update.Evidence = full.Evidence
+	}
+	if groups["feature"] {
+		update.Feature = full.Feature
+	}
+	if groups["synchrony"] {
+		update.Synchrony = full.Synchrony
+	}
+	return update
+}
+
+// checkParamsTx checks a consensus parameters transaction against the committed parameters, as
+// if it was the only one in the next block.
+func (app *KVStoreApplication) checkParamsTx(tx []byte) (uint32, error) {
+	changes, err := parseParamsTx(tx)
+	if err != nil {
+		return codeTypeInvalidParamsTx, err
+	}
+	params, err := app.loadConsensusParams(db.LatestVersion)
+	if err != nil {
+		app.logger.Error("abci", "method", "CheckTx", "msg", "error loading consensus params", "err", err)
+		return codeTypeInternalError, errors.New("error loading consensus params")
+	}
+	if err := newParamsUpdate(params).apply(changes, app.state.Height+1); err != nil {
+		return codeTypeInvalidParamsTx, err
+	}
+	return codeTypeOK, nil
+}
+
+// loadConsensusParams returns the consensus parameters stored at version, or the CometBFT
+// defaults if none were stored.
+func (app *KVStoreApplication) loadConsensusParams(version int64) (*cmtproto.ConsensusParams, error) {
+	bz, err := app.store.Get(paramsKey, version)
+	if err != nil {
+		return nil, err
+	}
+	if bz == nil {
+		params := cmttypes.DefaultConsensusParams().ToProto()
+		return &params, nil
+	}
+	params := &cmtproto.ConsensusParams{}
+	if err := params.Unmarshal(bz); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func saveConsensusParams(w *stateWriter, params *cmtproto.ConsensusParams) error {
+	if params == nil {
+		return errors.New("nil consensus params")
+	}
+	bz, err := params.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.Set(paramsKey, bz)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
+
+	db "kvstore/database"
+)
+
+// paramsString returns the groups of params that are set, with the parameters paramsTx can set.
+func paramsString(params *cmtproto.ConsensusParams) string {
+	if params == nil {
+		return "none"
+	}
+	var groups []string
+	if b := params.Block; b != nil {
+		groups = append(groups, fmt.Sprintf("block.max_bytes=%d,block.max_gas=%d", b.MaxBytes, b.MaxGas))
+	}
+	if e := params.Evidence; e != nil {
+		groups = append(groups, fmt.Sprintf("evidence.max_age_num_blocks=%d,evidence.max_age_duration=%s,evidence.max_bytes=%d",
+			e.MaxAgeNumBlocks, e.MaxAgeDuration, e.MaxBytes))
+	}
+	if f := params.Feature; f != nil {
+		groups = append(groups, fmt.Sprintf("feature.vote_extensions_enable_height=%d,feature.pbts_enable_height=%d",
+			f.VoteExtensionsEnableHeight.GetValue(), f.PbtsEnableHeight.GetValue()))
+	}
+	if s := params.Synchrony; s != nil {
+		groups = append(groups, fmt.Sprintf("synchrony.precision=%s,synchrony.message_delay=%s", s.Precision, s.MessageDelay))
+	}
+	return strings.Join(groups, " ")
+}
+
+func TestParamsTxs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		genesis string
+		txs     []string
+		codes   []uint32
+		update  string // the consensus params update returned by FinalizeBlock
+	}{
+		{
+			name:   "block",
+			txs:    []string{"params:block.max_bytes=2097152,block.max_gas=1000"},
+			codes:  []uint32{codeTypeOK},
+			update: "block.max_bytes=2097152,block.max_gas=1000",
+		},
+		{
+			name:   "evidence",
+			txs:    []string{"params:evidence.max_age_duration=1h,evidence.max_bytes=1000"},
+			codes:  []uint32{codeTypeOK},
+			update: "evidence.max_age_num_blocks=100000,evidence.max_age_duration=1h0m0s,evidence.max_bytes=1000",
+		},
+		{
+			name:   "synchrony",
+			txs:    []string{"params:synchrony.precision=1s"},
+			codes:  []uint32{codeTypeOK},
+			update: "synchrony.precision=1s,synchrony.message_delay=2s",
+		},
+		{
+			name:   "changes of several transactions",
+			txs:    []string{"params:block.max_bytes=2097152", "params:synchrony.message_delay=2s", "params:block.max_gas=1000"},
+			codes:  []uint32{codeTypeOK, codeTypeOK, codeTypeOK},
+			update: "block.max_bytes=2097152,block.max_gas=1000 synchrony.precision=500ms,synchrony.message_delay=2s",
+		},
+		{
+			name:   "unknown parameter",
+			txs:    []string{"params:block.unknown=1"},
+			codes:  []uint32{codeTypeInvalidParamsTx},
+			update: "none",
+		},
+		{
+			name:   "invalid value",
+			txs:    []string{"params:block.max_bytes=x"},
+			codes:  []uint32{codeTypeInvalidParamsTx},
+			update: "none",
+		},
+		{
+			name:   "invalid params",
+			txs:    []string{"params:block.max_bytes=0"},
+			codes:  []uint32{codeTypeInvalidParamsTx},
+			update: "none",
+		},
+		{
+			name:   "invalid change after a valid one",
+			txs:    []string{"params:block.max_gas=1000", "params:block.max_bytes=0"},
+			codes:  []uint32{codeTypeOK, codeTypeInvalidParamsTx},
+			update: "block.max_bytes=4194304,block.max_gas=1000",
+		},
+		{
+			name:   "enable vote extensions",
+			txs:    []string{"params:feature.vote_extensions_enable_height=5"},
+			codes:  []uint32{codeTypeOK},
+			update: "feature.vote_extensions_enable_height=5,feature.pbts_enable_height=0",
+		},
+		{
+			name:   "enable vote extensions at the current height",
+			txs:    []string{"params:feature.vote_extensions_enable_height=1"},
+			codes:  []uint32{codeTypeInvalidParamsTx},
+			update: "none",
+		},
+		{
+			name:   "enable vote extensions at a negative height",
+			txs:    []string{"params:feature.vote_extensions_enable_height=-1"},
+			codes:  []uint32{codeTypeInvalidParamsTx},
+			update: "none",
+		},
+		{
+			name:    "disable enabled vote extensions",
+			genesis: `{"consensus_params": {"feature.vote_extensions_enable_height": "1"}}`,
+			txs:     []string{"params:feature.vote_extensions_enable_height=0"},
+			codes:   []uint32{codeTypeInvalidParamsTx},
+			update:  "none",
+		},
+		{
+			name:    "move enabled vote extensions",
+			genesis: `{"consensus_params": {"feature.vote_extensions_enable_height": "1"}}`,
+			txs:     []string{"params:feature.vote_extensions_enable_height=5"},
+			codes:   []uint32{codeTypeInvalidParamsTx},
+			update:  "none",
+		},
+		{
+			name:    "disable vote extensions not enabled yet",
+			genesis: `{"consensus_params": {"feature.vote_extensions_enable_height": "10"}}`,
+			txs:     []string{"params:feature.vote_extensions_enable_height=0"},
+			codes:   []uint32{codeTypeOK},
+			update:  "feature.vote_extensions_enable_height=0,feature.pbts_enable_height=0",
+		},
+		{
+			name:   "enable PBTS",
+			txs:    []string{"params:feature.pbts_enable_height=3,synchrony.precision=1s"},
+			codes:  []uint32{codeTypeOK},
+			update: "feature.vote_extensions_enable_height=0,feature.pbts_enable_height=3 synchrony.precision=1s,synchrony.message_delay=2s",
+		},
+		{
+			name:   "enable PBTS at a past height",
+			txs:    []string{"params:feature.pbts_enable_height=3", "params:feature.pbts_enable_height=1"},
+			codes:  []uint32{codeTypeOK, codeTypeInvalidParamsTx},
+			update: "feature.vote_extensions_enable_height=0,feature.pbts_enable_height=3",
+		},
+		{
+			name:    "disable enabled PBTS",
+			genesis: `{"consensus_params": {"feature.pbts_enable_height": "1"}}`,
+			txs:     []string{"params:feature.pbts_enable_height=0"},
+			codes:   []uint32{codeTypeInvalidParamsTx},
+			update:  "none",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			genesis := tc.genesis
+			if genesis == "" {
+				genesis = "{}"
+			}
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, genesis)
+
+			// CheckTx checks the first transaction against the committed parameters, the others
+			// depend on it.
+			check, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tc.txs[0]), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.Code != tc.codes[0] {
+				t.Fatalf("CheckTx code %d (%s), want %d", check.Code, check.Log, tc.codes[0])
+			}
+
+			resp := finalizeBlock(t, app, 1, tc.txs...)
+			for i, result := range resp.TxResults {
+				if result.Code != tc.codes[i] {
+					t.Fatalf("tx %d: code %d (%s), want %d", i, result.Code, result.Log, tc.codes[i])
+				}
+			}
+			if update := paramsString(resp.ConsensusParamUpdates); update != tc.update {
+				t.Fatalf("consensus params update %s, want %s", update, tc.update)
+			}
+			before, err := app.loadConsensusParams(db.LatestVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The stored parameters are the ones CometBFT applies from the next height on.
+			params, err := app.loadConsensusParams(db.LatestVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := cmttypes.ConsensusParamsFromProto(*before).Update(resp.ConsensusParamUpdates)
+			want := next.ToProto()
+			if paramsString(params) != paramsString(&want) {
+				t.Fatalf("stored consensus params %s, want %s", paramsString(params), paramsString(&want))
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// proposalStrategy changes the transactions of a proposal prepared by this node. The configured
+// strategies are applied in order to the transactions of the mempool, and the transactions that
+// do not fit in MaxTxBytes are dropped after them, see PrepareProposal.
+type proposalStrategy func(app *KVStoreApplication, req *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte
+
+var proposalStrategies = map[string]proposalStrategy{
+	// max-tx-bytes drops the transactions that do not fit in MaxTxBytes before the next
+	// strategies.
+	"max-tx-bytes": maxTxBytesStrategy,
+
+	// priority orders the transactions by decreasing priority, see getTxMeta.
+	"priority": priorityStrategy,
+
+	// drop-invalid drops the transactions that fail CheckTx against the committed state with
+	// the transactions before them.
+	"drop-invalid": dropInvalidStrategy,
+
+	// inject adds a transaction generated by the proposer before the others, setting the time
+	// key to the time of the block.
+	"inject": injectStrategy,
+
+	// shuffle shuffles the transactions, so that proposers order them differently.
+	"shuffle": shuffleStrategy,
+
+	// reverse reverses the order of the transactions.
+	"reverse": reverseStrategy,
+}
+
+// validateProposalStrategies checks that the names of the strategies are known.
+func validateProposalStrategies(names []string) error {
+	for _, name := range names {
+		if _, ok := proposalStrategies[name]; !ok {
+			return fmt.Errorf("unknown proposal strategy %q", name)
+		}
+	}
+	return nil
+}
+
+// validateRejections checks the settings making this node reject proposals, see Config.
+func (cfg Config) validateRejections() error {
+	if cfg.RejectProbability < 0 || cfg.RejectProbability > 1 {
+		return fmt.Errorf("reject_probability %v is not between 0 and 1", cfg.RejectProbability)
+	}
+	if cfg.RejectProposer != "" {
+		// An address that cannot match any proposer would silently disable the rejections.
+		addr, err := hex.DecodeString(cfg.RejectProposer)
+		if err != nil {
+			return fmt.Errorf("reject_proposer: %w", err)
+		}
+		if len(addr) != crypto.AddressSize {
+			return fmt.Errorf("reject_proposer has %d bytes, expected %d", len(addr), crypto.AddressSize)
+		}
+	}
+	return nil
+}
+
+func maxTxBytesStrategy(_ *KVStoreApplication, req *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	var kept [][]byte
+	var size int64
+	for _, tx := range txs {
+		txSize := cmttypes.ComputeProtoSizeForTxs([]cmttypes.Tx{tx})
+		if size+txSize > req.MaxTxBytes {
+			continue
+		}
+		size += txSize
+		kept = append(kept, tx)
+	}
+	return kept
+}
+
+func priorityStrategy(app *KVStoreApplication, _ *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	type prioritizedTx struct {
+		tx       []byte
+		priority int64
+	}
+	prioritized := make([]prioritizedTx, len(txs))
+	for i, tx := range txs {
+		prioritized[i].tx = tx
+		if code, _ := app.isValid(tx); code == codeTypeOK {
+			prioritized[i].priority = getTxMeta(tx).priority
+		}
+	}
+	sort.SliceStable(prioritized, func(i, j int) bool {
+		return prioritized[i].priority > prioritized[j].priority
+	})
+
+	sorted := make([][]byte, len(txs))
+	for i := range prioritized {
+		sorted[i] = prioritized[i].tx
+	}
+	return sorted
+}
+
+func dropInvalidStrategy(app *KVStoreApplication, _ *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	s := app.newCheckState()
+	var kept [][]byte
+	for _, tx := range txs {
+		if code, err := app.checkTx(s, tx); code != codeTypeOK {
+			app.logger.Info("abci", "method", "PrepareProposal", "msg", "dropping invalid tx", "code", code, "err", err)
+			continue
+		}
+		kept = append(kept, tx)
+	}
+	return kept
+}
+
+func injectStrategy(_ *KVStoreApplication, req *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	tx := []byte("time=" + req.Time.UTC().Format(time.RFC3339Nano))
+	return append([][]byte{tx}, txs...)
+}
+
+func shuffleStrategy(_ *KVStoreApplication, _ *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	shuffled := slices.Clone(txs)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+func reverseStrategy(_ *KVStoreApplication, _ *abcitypes.PrepareProposalRequest, txs [][]byte) [][]byte {
+	reversed := slices.Clone(txs)
+	slices.Reverse(reversed)
+	return reversed
+}
+
+// Reasons for which this node rejects proposals, see Config.
+const (
+	rejectInvalidTxs   = "invalid_txs"
+	rejectTooManyTxs   = "too_many_txs"
+	rejectTooManyBytes = "too_many_bytes"
+	rejectRandom       = "random"
+	rejectProposer     = "proposer"
+	rejectOracleTx     = "invalid_oracle_tx"
+)
+
+// proposalRejection returns the reason this node rejects the proposal for, or "" if it accepts
+// it, with details for the logs. Proposals with an invalid oracle transaction, or with one that
+// is not their first transaction, are always rejected. So are proposals without one once vote
+// extensions are enabled at the previous height: the extensions of its last commit were
+// accepted by validators holding more than 2/3 of the voting power, so a correct proposer
+// always aggregates them, unless the oracle transaction does not fit in MaxTxBytes.
+func (app *KVStoreApplication) proposalRejection(req *abcitypes.ProcessProposalRequest) (string, string) {
+	if enabled, err := app.voteExtensionsEnabled(req.Height - 1); err != nil {
+		return rejectOracleTx, err.Error()
+	} else if enabled && (len(req.Txs) == 0 || !isOracleTx(req.Txs[0])) {
+		return rejectOracleTx, "missing oracle transaction"
+	}
+	for i, tx := range req.Txs {
+		if wrapsOracleTx(tx) {
+			return rejectOracleTx, fmt.Sprintf("tx %d wraps an oracle transaction", i)
+		}
+		if !isOracleTx(tx) {
+			continue
+		}
+		if i != 0 {
+			return rejectOracleTx, fmt.Sprintf("tx %d is an oracle transaction", i)
+		}
+		if err := app.verifyOracleTx(tx, req.Height); err != nil {
+			return rejectOracleTx, err.Error()
+		}
+	}
+	if app.cfg.RejectProposer != "" && strings.EqualFold(app.cfg.RejectProposer, hex.EncodeToString(req.ProposerAddress)) {
+		return rejectProposer, fmt.Sprintf("proposer %X", req.ProposerAddress)
+	}
+	if app.cfg.MaxProposalTxs > 0 && len(req.Txs) > app.cfg.MaxProposalTxs {
+		return rejectTooManyTxs, fmt.Sprintf("%d txs, maximum %d", len(req.Txs), app.cfg.MaxProposalTxs)
+	}
+	if app.cfg.MaxProposalBytes > 0 {
+		var size int64
+		for _, tx := range req.Txs {
+			size += int64(len(tx))
+		}
+		if size > app.cfg.MaxProposalBytes {
+			return rejectTooManyBytes, fmt.Sprintf("%d bytes, maximum %d", size, app.cfg.MaxProposalBytes)
+		}
+	}
+	if app.cfg.RejectInvalidTxs {
+		s := app.newCheckState()
+		for i, tx := range req.Txs {
+			if isOracleTx(tx) {
+				continue
+			}
+			if code, err := app.checkTx(s, tx); code != codeTypeOK {
+				return rejectInvalidTxs, fmt.Sprintf("tx %d has code %d: %v", i, code, err)
+			}
+		}
+	}
+	if app.cfg.RejectProbability > 0 && rand.Float64() < app.cfg.RejectProbability {
+		return rejectRandom, fmt.Sprintf("probability %v", app.cfg.RejectProbability)
+	}
+	return "", ""
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	cmttypes "github.com/cometbft/cometbft/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// txsSize returns the size of txs in a proposal.
+func txsSize(txs ...string) int64 {
+	var size int64
+	for _, tx := range txs {
+		size += cmttypes.ComputeProtoSizeForTxs([]cmttypes.Tx{[]byte(tx)})
+	}
+	return size
+}
+
+func TestPrepareProposal(t *testing.T) {
+	blockTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	const timeTx = "time=2026-01-02T03:04:05Z"
+
+	testCases := []struct {
+		name       string
+		strategies []string
+		txs        []string
+		maxTxBytes int64 // no limit if 0
+		want       []string
+	}{
+		{
+			name: "no strategy",
+			txs:  []string{"a=1", "b=2"},
+			want: []string{"a=1", "b=2"},
+		},
+		{
+			name:       "no strategy with too many bytes",
+			txs:        []string{"a=1", "b=22", "c=3"},
+			maxTxBytes: txsSize("a=1", "c=3"),
+			want:       []string{"a=1", "c=3"},
+		},
+		{
+			name:       "max-tx-bytes",
+			strategies: []string{"max-tx-bytes"},
+			txs:        []string{"a=1", "b=2", "c=3"},
+			maxTxBytes: txsSize("a=1", "b=2"),
+			want:       []string{"a=1", "b=2"},
+		},
+		{
+			name:       "priority",
+			strategies: []string{"priority"},
+			txs:        []string{"a=1", "fee:5!b=2", "fee:9!c=3", "fee:5!d=4"},
+			want:       []string{"fee:9!c=3", "fee:5!b=2", "fee:5!d=4", "a=1"},
+		},
+		{
+			name:       "priority then max-tx-bytes",
+			strategies: []string{"priority", "max-tx-bytes"},
+			txs:        []string{"a=1", "fee:5!b=2", "fee:9!c=3"},
+			maxTxBytes: txsSize("fee:9!c=3", "fee:5!b=2"),
+			want:       []string{"fee:9!c=3", "fee:5!b=2"},
+		},
+		{
+			name:       "drop-invalid",
+			strategies: []string{"drop-invalid"},
+			txs:        []string{"cas:k=2=3", "cas:k=1=2", "x", "cas:k=2=3", "cas:k=1=2"},
+			want:       []string{"cas:k=1=2", "cas:k=2=3"},
+		},
+		{
+			name:       "inject",
+			strategies: []string{"inject"},
+			txs:        []string{"a=1"},
+			want:       []string{timeTx, "a=1"},
+		},
+		{
+			name:       "inject after max-tx-bytes",
+			strategies: []string{"max-tx-bytes", "inject"},
+			txs:        []string{"a=1", "b=2"},
+			maxTxBytes: txsSize("a=1", "b=2"),
+			want:       []string{"a=1", "b=2"},
+		},
+		{
+			name:       "inject first",
+			strategies: []string{"inject", "max-tx-bytes"},
+			txs:        []string{"a=1", "b=2"},
+			maxTxBytes: txsSize(timeTx, "a=1"),
+			want:       []string{timeTx, "a=1"},
+		},
+		{
+			name:       "reverse",
+			strategies: []string{"reverse"},
+			txs:        []string{"a=1", "b=2", "c=3"},
+			maxTxBytes: txsSize("c=3", "b=2"),
+			want:       []string{"c=3", "b=2"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ProposalStrategies = tc.strategies
+			app := newTestApp(t, cfg)
+			initChain(t, app, `{"kvs": {"k": "1"}}`)
+
+			maxTxBytes := tc.maxTxBytes
+			if maxTxBytes == 0 {
+				maxTxBytes = 1 << 20
+			}
+			req := &abcitypes.PrepareProposalRequest{Height: 1, Time: blockTime, MaxTxBytes: maxTxBytes}
+			for _, tx := range tc.txs {
+				req.Txs = append(req.Txs, []byte(tx))
+			}
+			resp, err := app.PrepareProposal(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var txs []string
+			for _, tx := range resp.Txs {
+				txs = append(txs, string(tx))
+			}
+			if fmt.Sprint(txs) != fmt.Sprint(tc.want) {
+				t.Fatalf("proposal %q, want %q", txs, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrepareProposalShuffle(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ProposalStrategies = []string{"inject", "shuffle"}
+	app := newTestApp(t, cfg)
+	initChain(t, app, `{}`)
+
+	var txs []string
+	for i := 0; i < 20; i++ {
+		txs = append(txs, fmt.Sprintf("k%d=%d", i, i))
+	}
+	// Whatever the order the shuffle leaves, the transactions are cut to MaxTxBytes.
+	req := &abcitypes.PrepareProposalRequest{Height: 1, Time: time.Now(), MaxTxBytes: txsSize(txs...)}
+	for _, tx := range txs {
+		req.Txs = append(req.Txs, []byte(tx))
+	}
+	resp, err := app.PrepareProposal(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, tx := range resp.Txs {
+		if !slices.Contains(txs, string(tx)) && !strings.HasPrefix(string(tx), "time=") {
+			t.Fatalf("unexpected tx %q", tx)
+		}
+		size += txsSize(string(tx))
+	}
+	if size > req.MaxTxBytes {
+		t.Fatalf("proposal of %d bytes, maximum %d", size, req.MaxTxBytes)
+	}
+}
+
+func TestProcessProposal(t *testing.T) {
+	proposer := bytes.Repeat([]byte{0xAB}, crypto.AddressSize)
+	testCases := []struct {
+		name   string
+		cfg    func(cfg *Config)
+		txs    []string
+		reason string // "" if the proposal is accepted
+	}{
+		{name: "default", cfg: func(cfg *Config) {}, txs: []string{"cas:k=2=3", "x"}},
+		{name: "invalid txs", cfg: func(cfg *Config) { cfg.RejectInvalidTxs = true }, txs: []string{"cas:k=1=2", "cas:k=1=3"}, reason: rejectInvalidTxs},
+		{name: "invalid format", cfg: func(cfg *Config) { cfg.RejectInvalidTxs = true }, txs: []string{"a=1", "x"}, reason: rejectInvalidTxs},
+		{name: "valid txs", cfg: func(cfg *Config) { cfg.RejectInvalidTxs = true }, txs: []string{"cas:k=1=2", "cas:k=2=3"}},
+		{name: "too many txs", cfg: func(cfg *Config) { cfg.MaxProposalTxs = 2 }, txs: []string{"a=1", "b=2", "c=3"}, reason: rejectTooManyTxs},
+		{name: "max txs", cfg: func(cfg *Config) { cfg.MaxProposalTxs = 2 }, txs: []string{"a=1", "b=2"}},
+		{name: "too many bytes", cfg: func(cfg *Config) { cfg.MaxProposalBytes = 5 }, txs: []string{"a=1", "b=2"}, reason: rejectTooManyBytes},
+		{name: "max bytes", cfg: func(cfg *Config) { cfg.MaxProposalBytes = 6 }, txs: []string{"a=1", "b=2"}},
+		{name: "random", cfg: func(cfg *Config) { cfg.RejectProbability = 1 }, txs: []string{"a=1"}, reason: rejectRandom},
+		{name: "rejected proposer", cfg: func(cfg *Config) { cfg.RejectProposer = strings.Repeat("ab", crypto.AddressSize) }, txs: []string{"a=1"}, reason: rejectProposer},
+		{name: "other proposer", cfg: func(cfg *Config) { cfg.RejectProposer = strings.Repeat("AB", crypto.AddressSize-1) + "AC" }, txs: []string{"a=1"}},
+		{name: "oracle tx after the first one", cfg: func(cfg *Config) {}, txs: []string{"a=1", "oracle:{}"}, reason: rejectOracleTx},
+		{name: "wrapped oracle tx", cfg: func(cfg *Config) {}, txs: []string{"fee:1!oracle:{}"}, reason: rejectOracleTx},
+		{name: "invalid oracle tx", cfg: func(cfg *Config) {}, txs: []string{"oracle:{}"}, reason: rejectOracleTx},
+		{name: "oracle tx before other reasons", cfg: func(cfg *Config) { cfg.RejectProbability = 1 }, txs: []string{"a=1", "oracle:{}"}, reason: rejectOracleTx},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			app := newTestApp(t, cfg)
+			initChain(t, app, `{"kvs": {"k": "1"}}`)
+
+			wantStatus := abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT
+			if tc.reason != "" {
+				wantStatus = abcitypes.PROCESS_PROPOSAL_STATUS_REJECT
+			}
+			counter := processedProposals.WithLabelValues(wantStatus.String(), tc.reason)
+			before := testutil.ToFloat64(counter)
+
+			req := &abcitypes.ProcessProposalRequest{Height: 1, ProposerAddress: proposer}
+			for _, tx := range tc.txs {
+				req.Txs = append(req.Txs, []byte(tx))
+			}
+			resp, err := app.ProcessProposal(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != wantStatus {
+				t.Fatalf("status %v, want %v", resp.Status, wantStatus)
+			}
+			if reason, details := app.proposalRejection(req); reason != tc.reason {
+				t.Fatalf("rejection reason %q (%s), want %q", reason, details, tc.reason)
+			}
+			if count := testutil.ToFloat64(counter) - before; count != 1 {
+				t.Fatalf("processed_proposals_total{status=%q,reason=%q} increased by %v, want 1", wantStatus, tc.reason, count)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	db "kvstore/database"
+	"kvstore/smt"
+)
+
+// pruneBatchSize is the number of versions or tree nodes deleted by each batch of the pruning,
+// between which progress is logged.
+const pruneBatchSize = 10_000
+
+func (cfg Config) validateRetention() error {
+	if cfg.RetainBlocks < 0 {
+		return errors.New("retain_blocks is negative")
+	}
+	if cfg.RetainFromSnapshot && cfg.SnapshotInterval == 0 {
+		return errors.New("retain_from_snapshot requires snapshots, snapshot_interval is 0")
+	}
+	return nil
+}
+
+// nextRetainHeight returns the retain height of the block committed at height, below which
+// CometBFT and the application prune blocks and state. It never decreases, since CometBFT refuses
+// to lower it. It is 0, meaning that nothing is pruned, until the retention policy prunes a height.
+func (app *KVStoreApplication) nextRetainHeight(height int64) int64 {
+	var retain int64
+	if app.cfg.RetainBlocks > 0 {
+		retain = height - app.cfg.RetainBlocks + 1
+	}
+	if app.cfg.RetainFromSnapshot {
+		list, err := app.snapshots.List()
+		if err != nil {
+			app.logger.Error("prune", "msg", "error listing snapshots, keeping the retain height", "err", err)
+			return app.retainHeight
+		}
+		if len(list) == 0 {
+			return app.retainHeight
+		}
+		if latest := int64(list[0].Height); retain == 0 || latest < retain {
+			retain = latest
+		}
+	}
+	if retain <= max(app.retainHeight, 1) {
+		return app.retainHeight
+	}
+	return retain
+}
+
+// saveRetainHeight adds the retain height to the batch committing a block, so that it never
+// decreases across restarts.
+func saveRetainHeight(batch db.Batch, height int64) error {
+	return batch.Set(retainHeightKey, binary.BigEndian.AppendUint64(nil, uint64(height)))
+}
+
+// maybePrune prunes the state below retainHeight in the background, unless it is already pruned.
+// Pruning is skipped while the previous one is still in progress, the next block prunes what it
+// skipped. Versions at and above retainHeight stay readable: only the versions they hide are
+// deleted. The writes of the pruning do not hit crash points, see db.PebbleDB.NewBackgroundBatch.
+func (app *KVStoreApplication) maybePrune(retainHeight int64) {
+	if retainHeight <= app.prunedHeight.Load() {
+		return
+	}
+	if !app.pruning.CompareAndSwap(false, true) {
+		app.logger.Debug("prune", "msg", "skipping pruning, previous one still in progress", "retain_height", retainHeight)
+		return
+	}
+	go func() {
+		defer app.pruning.Store(false)
+		start := time.Now()
+		app.logger.Info("prune", "msg", "pruning state", "retain_height", retainHeight)
+
+		// The app hashes are deleted first, so that queries at pruned heights fail with
+		// codeTypePrunedHeight rather than read pruned versions.
+		hashes, err := app.pruneAppHashes(retainHeight)
+		if err != nil {
+			app.logger.Error("prune", "msg", "error pruning app hashes", "retain_height", retainHeight, "err", err)
+			return
+		}
+		versions, err := app.store.Prune(app.db.NewBackgroundBatch, retainHeight, pruneBatchSize, func(deleted int) {
+			app.logger.Info("prune", "msg", "pruning state", "retain_height", retainHeight, "deleted_versions", deleted)
+		})
+		if err != nil {
+			app.logger.Error("prune", "msg", "error pruning state", "retain_height", retainHeight, "err", err)
+			return
+		}
+		nodes, err := smt.Prune(app.db, app.db.NewBackgroundBatch, &app.treeMtx, retainHeight, pruneBatchSize, func(deleted int) {
+			app.logger.Info("prune", "msg", "pruning tree", "retain_height", retainHeight, "deleted_nodes", deleted)
+		})
+		if err != nil {
+			app.logger.Error("prune", "msg", "error pruning tree", "retain_height", retainHeight, "err", err)
+			return
+		}
+		app.prunedHeight.Store(retainHeight)
+		app.logger.Info("prune", "msg", "state pruned", "retain_height", retainHeight, "app_hashes", hashes,
+			"deleted_versions", versions, "deleted_nodes", nodes, "duration", time.Since(start))
+	}()
+}
+
+// pruneAppHashes deletes the app hashes of the heights below retainHeight, and returns how many
+// were deleted.
+func (app *KVStoreApplication) pruneAppHashes(retainHeight int64) (int, error) {
+	itr, err := app.db.Iterator(appHashPrefix, appHashKey(retainHeight))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+	batch := app.db.NewBackgroundBatch()
+	defer batch.Close()
+	deleted := 0
+	for ; itr.Valid(); itr.Next() {
+		if err := batch.Delete(append([]byte{}, itr.Key()...)); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+	if err := itr.Error(); err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, batch.Write()
+}
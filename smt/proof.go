@@ -0,0 +1,182 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cmtcrypto "github.com/cometbft/cometbft/api/cometbft/crypto/v1"
+	"github.com/cometbft/cometbft/crypto/merkle"
+
+	"kvstore/utils"
+)
+
+// ProofOpType is the type of the proof operations returned by ProofOp.
+const ProofOpType = "kvstore++:smt"
+
+var errInvalidProof = errors.New("invalid proof")
+
+// Proof proves the membership or non-membership of a key in the tree. It holds the siblings on
+// the path from the root to the node where the key would be, and the leaf found at that node,
+// if any. For a key that is not in the tree that leaf belongs to a different key.
+type Proof struct {
+	Siblings      [][]byte `json:"siblings"`
+	LeafPath      []byte   `json:"leaf_path,omitempty"`
+	LeafValueHash []byte   `json:"leaf_value_hash,omitempty"`
+}
+
+// Prove returns a proof for key against the current root. The proof shows that the key has its
+// current value, or that it is absent if it is not in the tree.
+func (t *Tree) Prove(key []byte) (*Proof, error) {
+	path := digest(key)
+	proof := &Proof{}
+	node := t.root
+	for depth := 0; !isEmpty(node); depth++ {
+		data, err := t.getNode(node)
+		if err != nil {
+			return nil, err
+		}
+		if isLeaf(data) {
+			leafPath, valueHash := leafFields(data)
+			proof.LeafPath, proof.LeafValueHash = utils.Copy(leafPath), utils.Copy(valueHash)
+			break
+		}
+		left, right := innerFields(data)
+		if bit(path, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, utils.Copy(right))
+			node = left
+		} else {
+			proof.Siblings = append(proof.Siblings, utils.Copy(left))
+			node = right
+		}
+	}
+	return proof, nil
+}
+
+// Root computes the root implied by the proof for key having value. A nil value stands for the
+// key being absent.
+func (p *Proof) Root(key, value []byte) ([]byte, error) {
+	if len(p.Siblings) > hashSize*8 {
+		return nil, fmt.Errorf("%w: too many siblings", errInvalidProof)
+	}
+	path := digest(key)
+	hasLeaf := p.LeafPath != nil
+	if hasLeaf && (len(p.LeafPath) != hashSize || len(p.LeafValueHash) != hashSize) {
+		return nil, fmt.Errorf("%w: malformed leaf", errInvalidProof)
+	}
+
+	if value != nil {
+		if !hasLeaf || !bytes.Equal(p.LeafPath, path) {
+			return nil, fmt.Errorf("%w: key is not the proven leaf", errInvalidProof)
+		}
+		if !bytes.Equal(p.LeafValueHash, digest(value)) {
+			return nil, fmt.Errorf("%w: value does not match the proven leaf", errInvalidProof)
+		}
+	} else if hasLeaf {
+		if bytes.Equal(p.LeafPath, path) {
+			return nil, fmt.Errorf("%w: key is present", errInvalidProof)
+		}
+		for depth := range p.Siblings {
+			if bit(p.LeafPath, depth) != bit(path, depth) {
+				return nil, fmt.Errorf("%w: leaf is not on the path of the key", errInvalidProof)
+			}
+		}
+	}
+
+	node := emptyHash
+	if hasLeaf {
+		node = digest(concat(leafPrefix, p.LeafPath, p.LeafValueHash))
+	}
+	for depth := len(p.Siblings) - 1; depth >= 0; depth-- {
+		sibling := p.Siblings[depth]
+		if len(sibling) != hashSize {
+			return nil, fmt.Errorf("%w: malformed sibling", errInvalidProof)
+		}
+		if bit(path, depth) == 0 {
+			node = digest(concat(innerPrefix, node, sibling))
+		} else {
+			node = digest(concat(innerPrefix, sibling, node))
+		}
+	}
+	return node, nil
+}
+
+// Verify checks the proof for key having value against root. A nil value checks that the key is
+// absent.
+func (p *Proof) Verify(root, key, value []byte) error {
+	computed, err := p.Root(key, value)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return fmt.Errorf("%w: root %X, want %X", errInvalidProof, computed, root)
+	}
+	return nil
+}
+
+// ProofOp is a merkle.ProofOperator for tree proofs. It takes the value of its key, or no value
+// for an absence proof, and returns the root of the tree.
+type ProofOp struct {
+	key   []byte
+	Proof *Proof
+}
+
+var _ merkle.ProofOperator = ProofOp{}
+
+func NewProofOp(key []byte, proof *Proof) ProofOp {
+	return ProofOp{key: key, Proof: proof}
+}
+
+// ProofOpDecoder decodes a ProofOp of type ProofOpType.
+func ProofOpDecoder(pop cmtcrypto.ProofOp) (merkle.ProofOperator, error) {
+	if pop.Type != ProofOpType {
+		return nil, fmt.Errorf("%w: unexpected type %v, want %v", errInvalidProof, pop.Type, ProofOpType)
+	}
+	var proof Proof
+	if err := json.Unmarshal(pop.Data, &proof); err != nil {
+		return nil, fmt.Errorf("%w: decoding data: %v", errInvalidProof, err)
+	}
+	return NewProofOp(pop.Key, &proof), nil
+}
+
+// ProofRuntime returns a merkle.ProofRuntime that can verify the proofs of this application.
+func ProofRuntime() *merkle.ProofRuntime {
+	prt := merkle.DefaultProofRuntime()
+	prt.RegisterOpDecoder(ProofOpType, ProofOpDecoder)
+	return prt
+}
+
+// Run implements merkle.ProofOperator.
+func (op ProofOp) Run(args [][]byte) ([][]byte, error) {
+	var value []byte
+	switch len(args) {
+	case 0:
+	case 1:
+		value = args[0]
+		if value == nil {
+			value = []byte{}
+		}
+	default:
+		return nil, fmt.Errorf("%w: expected at most one argument, got %d", errInvalidProof, len(args))
+	}
+	root, err := op.Proof.Root(op.key, value)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{root}, nil
+}
+
+// GetKey implements merkle.ProofOperator.
+func (op ProofOp) GetKey() []byte {
+	return op.key
+}
+
+// ProofOp implements merkle.ProofOperator.
+func (op ProofOp) ProofOp() cmtcrypto.ProofOp {
+	bz, err := json.Marshal(op.Proof)
+	if err != nil {
+		panic(err)
+	}
+	return cmtcrypto.ProofOp{Type: ProofOpType, Key: op.key, Data: bz}
+}
@@ -0,0 +1,101 @@
+package smt
+
+import (
+	"errors"
+	"testing"
+
+	cmtcrypto "github.com/cometbft/cometbft/api/cometbft/crypto/v1"
+	"github.com/cometbft/cometbft/crypto/merkle"
+)
+
+func proofOps(t *testing.T, tree *Tree, key []byte) *cmtcrypto.ProofOps {
+	t.Helper()
+	proof, err := tree.Prove(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cmtcrypto.ProofOps{Ops: []cmtcrypto.ProofOp{NewProofOp(key, proof).ProofOp()}}
+}
+
+func keyPath(key []byte) string {
+	return merkle.KeyPath{}.AppendKey(key, merkle.KeyEncodingURL).String()
+}
+
+func TestProofRuntime(t *testing.T) {
+	pebble := newTestDB(t)
+	tree := NewTree(pebble, nil)
+	apply(t, tree, []op{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"\x00\xff", "zero"}})
+	single := NewTree(pebble, nil)
+	apply(t, single, []op{{"a", "1"}})
+
+	testCases := []struct {
+		name  string
+		tree  *Tree
+		key   string
+		value string // empty for an absence proof
+		valid bool
+	}{
+		{name: "membership", tree: tree, key: "b", value: "2", valid: true},
+		{name: "membership of a binary key", tree: tree, key: "\x00\xff", value: "zero", valid: true},
+		{name: "absence", tree: tree, key: "d", valid: true},
+		{name: "absence in a tree of one leaf", tree: single, key: "b", valid: true},
+		{name: "absence in an empty tree", tree: NewTree(pebble, nil), key: "a", valid: true},
+		{name: "wrong value", tree: tree, key: "b", value: "3", valid: false},
+		{name: "membership of a missing key", tree: tree, key: "d", value: "1", valid: false},
+		{name: "absence of a present key", tree: tree, key: "a", valid: false},
+		{name: "absence of the only key", tree: single, key: "a", valid: false},
+	}
+	prt := ProofRuntime()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := []byte(tc.key)
+			ops := proofOps(t, tc.tree, key)
+			var err error
+			if tc.value == "" {
+				err = prt.VerifyAbsence(ops, tc.tree.Root(), keyPath(key))
+			} else {
+				err = prt.VerifyValue(ops, tc.tree.Root(), keyPath(key), []byte(tc.value))
+			}
+			if tc.valid && err != nil {
+				t.Fatalf("expected a valid proof, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an invalid proof")
+			}
+		})
+	}
+}
+
+func TestProofTampered(t *testing.T) {
+	pebble := newTestDB(t)
+	tree := NewTree(pebble, nil)
+	apply(t, tree, []op{{"a", "1"}, {"b", "2"}, {"c", "3"}})
+	root := tree.Root()
+
+	testCases := []struct {
+		name   string
+		tamper func(p *Proof)
+	}{
+		{name: "flipped sibling", tamper: func(p *Proof) { p.Siblings[0][0] ^= 1 }},
+		{name: "missing sibling", tamper: func(p *Proof) { p.Siblings = p.Siblings[1:] }},
+		{name: "short sibling", tamper: func(p *Proof) { p.Siblings[0] = p.Siblings[0][1:] }},
+		{name: "flipped value hash", tamper: func(p *Proof) { p.LeafValueHash[0] ^= 1 }},
+		{name: "malformed leaf", tamper: func(p *Proof) { p.LeafPath = p.LeafPath[1:] }},
+		{name: "too many siblings", tamper: func(p *Proof) {
+			p.Siblings = make([][]byte, hashSize*8+1)
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proof, err := tree.Prove([]byte("b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.tamper(proof)
+			err = proof.Verify(root, []byte("b"), []byte("2"))
+			if !errors.Is(err, errInvalidProof) {
+				t.Fatalf("expected %v, got %v", errInvalidProof, err)
+			}
+		})
+	}
+}
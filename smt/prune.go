@@ -0,0 +1,118 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	db "kvstore/database"
+)
+
+var (
+	// orphanPrefix is the key prefix under which the version a node was orphaned at is stored,
+	// by node hash.
+	orphanPrefix = []byte("smtorphan/")
+
+	// orphanVersionPrefix is the key prefix under which the orphaned nodes are indexed by the
+	// version they were orphaned at, for Prune.
+	orphanVersionPrefix = []byte("smtorphans/")
+)
+
+// Prune deletes the nodes that only the roots of the versions below version reach: the nodes
+// orphaned at version or below, see Tree.Write. The roots of version and later versions can still
+// be opened.
+//
+// The deletes are written in batches created by newBatch of about batchSize nodes. A node orphaned
+// in the past can be created again, which deletes its orphan records, so every batch checks that
+// the records of its nodes are current and is written while holding lock, which must also be held
+// while the batches of Tree.Write are written. progress is called with the number of nodes deleted
+// so far after every batch. Prune returns the number of deleted nodes.
+func Prune(r db.Reader, newBatch func() db.Batch, lock sync.Locker, version int64, batchSize int, progress func(deleted int)) (int, error) {
+	itr, err := r.Iterator(orphanVersionPrefix, orphanVersionKey(version+1, nil))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	type orphan struct {
+		version int64
+		hash    []byte
+	}
+	deleted := 0
+	var orphans []orphan
+	flush := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		batch := newBatch()
+		defer batch.Close()
+		n := 0
+		for _, o := range orphans {
+			bz, err := r.Get(orphanKey(o.hash))
+			if err != nil {
+				return err
+			}
+			if bz == nil || decodeVersion(bz) != o.version {
+				// The node was created again since it was orphaned at o.version.
+				continue
+			}
+			for _, key := range [][]byte{nodeKey(o.hash), orphanKey(o.hash), orphanVersionKey(o.version, o.hash)} {
+				if err := batch.Delete(key); err != nil {
+					return err
+				}
+			}
+			n++
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		deleted += n
+		orphans = orphans[:0]
+		progress(deleted)
+		return nil
+	}
+	for ; itr.Valid(); itr.Next() {
+		key := itr.Key()[len(orphanVersionPrefix):]
+		orphans = append(orphans, orphan{version: decodeVersion(key[:8]), hash: bytes.Clone(key[8:])})
+		if len(orphans) >= batchSize {
+			if err := flush(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return deleted, err
+	}
+	if len(orphans) > 0 {
+		if err := flush(); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Clear adds to the batch the deletes of every node and orphan record stored in r, so that a tree
+// can be rebuilt from scratch.
+func Clear(r db.Reader, batch db.Batch) error {
+	for _, prefix := range [][]byte{nodePrefix, orphanPrefix, orphanVersionPrefix} {
+		if err := db.DeletePrefix(r, batch, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orphanKey(hash []byte) []byte {
+	return concat(orphanPrefix, hash)
+}
+
+func orphanVersionKey(version int64, hash []byte) []byte {
+	return concat(orphanVersionPrefix, encodeVersion(version), hash)
+}
+
+func encodeVersion(version int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(version))
+}
+
+func decodeVersion(bz []byte) int64 {
+	return int64(binary.BigEndian.Uint64(bz))
+}
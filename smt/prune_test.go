@@ -0,0 +1,113 @@
+package smt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	db "kvstore/database"
+)
+
+// writeVersion writes the nodes of the tree at version.
+func writeVersion(t *testing.T, pebble *db.PebbleDB, tree *Tree, version int64) {
+	t.Helper()
+	batch := pebble.NewBatch()
+	defer batch.Close()
+	if err := tree.Write(batch, version); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneOrphans(t *testing.T) {
+	var keys []string
+	var initial []op
+	for i := 0; i < 8; i++ {
+		keys = append(keys, fmt.Sprintf("k%d", i))
+		initial = append(initial, op{keys[i], "1"})
+	}
+	// The versions orphan nodes and create some of them again: version 4 creates the leaf of k0
+	// orphaned at 2, and version 5 goes back to the tree of version 1.
+	versions := [][]op{
+		initial,
+		{{"k0", "2"}},
+		{{"k1", "2"}, {"k2", ""}},
+		{{"k0", "1"}},
+		{{"k1", "1"}, {"k2", "1"}},
+	}
+	const retain = 4
+
+	pebble := newTestDB(t)
+	tree := NewTree(pebble, nil)
+	var roots [][]byte
+	states := []map[string]string{{}}
+	write := func(ops []op) {
+		apply(t, tree, ops)
+		writeVersion(t, pebble, tree, int64(len(roots)+1))
+		roots = append(roots, tree.Root())
+		state := map[string]string{}
+		for key, value := range states[len(states)-1] {
+			state[key] = value
+		}
+		for _, o := range ops {
+			if o.value == "" {
+				delete(state, o.key)
+			} else {
+				state[o.key] = o.value
+			}
+		}
+		states = append(states, state)
+	}
+	for _, ops := range versions[:retain] {
+		write(ops)
+	}
+
+	// The last version is written while pruning, after the first batch, so that the nodes it
+	// creates again are still listed as orphans by Prune.
+	batches := 0
+	deleted, err := Prune(pebble, func() db.Batch { return pebble.NewBatch() }, &sync.Mutex{}, retain, 1, func(int) {
+		if batches++; batches == 1 {
+			write(versions[retain])
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 || batches < 2 {
+		t.Fatalf("deleted %d nodes in %d batches", deleted, batches)
+	}
+	if string(roots[retain]) != string(roots[0]) {
+		t.Fatalf("root %X of version %d, want the root %X of version 1", roots[retain], retain+1, roots[0])
+	}
+
+	for version := int64(retain); version <= int64(len(roots)); version++ {
+		root := roots[version-1]
+		tree := NewTree(pebble, root)
+		for _, key := range keys {
+			proof, err := tree.Prove([]byte(key))
+			if err != nil {
+				t.Fatalf("version %d: proving %s: %v", version, key, err)
+			}
+			var value []byte
+			if v, ok := states[version][key]; ok {
+				value = []byte(v)
+			}
+			if err := proof.Verify(root, []byte(key), value); err != nil {
+				t.Fatalf("version %d: proof of %s=%s: %v", version, key, value, err)
+			}
+		}
+	}
+
+	// Every orphan record up to the retain height is gone, deleted by Prune or by the version
+	// creating the node again.
+	itr, err := pebble.Iterator(orphanVersionPrefix, orphanVersionKey(retain+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+	if itr.Valid() {
+		t.Fatalf("orphan record %X left after pruning", itr.Key())
+	}
+}
@@ -0,0 +1,313 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	db "kvstore/database"
+	"kvstore/utils"
+)
+
+const hashSize = sha256.Size
+
+var (
+	// nodePrefix is the key prefix under which tree nodes are stored.
+	nodePrefix = []byte("smt/")
+
+	leafPrefix  = []byte{0}
+	innerPrefix = []byte{1}
+
+	// emptyHash is the hash of an empty subtree.
+	emptyHash = make([]byte, hashSize)
+
+	errMissingNode = errors.New("tree node not found")
+)
+
+// Tree is a sparse Merkle tree over the SHA-256 digests of its keys. Leaves commit to the key
+// digest and the SHA-256 digest of the value, the values themselves are stored by the caller.
+//
+// Nodes are content-addressed, so the nodes of a root remain valid after later updates and a
+// tree can be reopened at any root it had before. A subtree holding a single leaf is collapsed
+// into that leaf, which makes the root independent of the order of updates.
+//
+// Updates are kept in memory until Write adds them to a batch.
+type Tree struct {
+	db      db.DB
+	root    []byte
+	pending map[string][]byte
+
+	// loaded are the hashes of the stored nodes read since the last Write, the nodes that
+	// updates may orphan.
+	loaded map[string]bool
+}
+
+// NewTree opens the tree with the given root. A nil or empty root opens an empty tree.
+func NewTree(db db.DB, root []byte) *Tree {
+	if len(root) == 0 {
+		root = emptyHash
+	}
+	return &Tree{
+		db:      db,
+		root:    utils.Copy(root),
+		pending: make(map[string][]byte),
+		loaded:  make(map[string]bool),
+	}
+}
+
+// EmptyRoot returns the root of a tree without leaves.
+func EmptyRoot() []byte {
+	return utils.Copy(emptyHash)
+}
+
+// Root returns the current root of the tree.
+func (t *Tree) Root() []byte {
+	return utils.Copy(t.root)
+}
+
+// Set inserts or updates the leaf for key.
+func (t *Tree) Set(key, value []byte) error {
+	root, err := t.insert(t.root, 0, digest(key), digest(value))
+	if err != nil {
+		return err
+	}
+	t.root = root
+	return nil
+}
+
+// Delete removes the leaf for key, or does nothing if the key is not in the tree.
+func (t *Tree) Delete(key []byte) error {
+	root, err := t.remove(t.root, 0, digest(key))
+	if err != nil {
+		return err
+	}
+	t.root = root
+	return nil
+}
+
+// Write adds the nodes created since the last call that the current root reaches to the batch,
+// and records the stored nodes it no longer reaches as orphaned at version, see Prune. Nodes
+// created and replaced since the last call are never written.
+func (t *Tree) Write(batch db.Batch, version int64) error {
+	written := make(map[string]bool)
+	kept := make(map[string]bool)
+	var walk func(hash []byte) error
+	walk = func(hash []byte) error {
+		data, ok := t.pending[string(hash)]
+		if !ok {
+			kept[string(hash)] = true
+			return nil
+		}
+		if written[string(hash)] {
+			return nil
+		}
+		written[string(hash)] = true
+		if err := batch.Set(nodeKey(hash), data); err != nil {
+			return err
+		}
+		if err := t.revive(batch, hash); err != nil {
+			return err
+		}
+		if isLeaf(data) {
+			return nil
+		}
+		left, right := innerFields(data)
+		if err := walk(left); err != nil {
+			return err
+		}
+		return walk(right)
+	}
+	if !isEmpty(t.root) {
+		if err := walk(t.root); err != nil {
+			return err
+		}
+	}
+	for hash := range t.loaded {
+		if written[hash] || kept[hash] {
+			continue
+		}
+		if err := batch.Set(orphanKey([]byte(hash)), encodeVersion(version)); err != nil {
+			return err
+		}
+		if err := batch.Set(orphanVersionKey(version, []byte(hash)), []byte{}); err != nil {
+			return err
+		}
+	}
+	t.pending = make(map[string][]byte)
+	t.loaded = make(map[string]bool)
+	return nil
+}
+
+// revive adds to the batch the deletes of the orphan records of the node with the given hash, if
+// it was orphaned before and is created again.
+func (t *Tree) revive(batch db.Batch, hash []byte) error {
+	bz, err := t.db.Get(orphanKey(hash))
+	if err != nil || bz == nil {
+		return err
+	}
+	if err := batch.Delete(orphanKey(hash)); err != nil {
+		return err
+	}
+	return batch.Delete(orphanVersionKey(decodeVersion(bz), hash))
+}
+
+func (t *Tree) insert(node []byte, depth int, path, valueHash []byte) ([]byte, error) {
+	if isEmpty(node) {
+		return t.putLeaf(path, valueHash), nil
+	}
+	data, err := t.getNode(node)
+	if err != nil {
+		return nil, err
+	}
+	if isLeaf(data) {
+		leafPath, _ := leafFields(data)
+		if bytes.Equal(leafPath, path) {
+			return t.putLeaf(path, valueHash), nil
+		}
+		return t.split(node, leafPath, t.putLeaf(path, valueHash), path, depth), nil
+	}
+
+	left, right := innerFields(data)
+	if bit(path, depth) == 0 {
+		left, err = t.insert(left, depth+1, path, valueHash)
+	} else {
+		right, err = t.insert(right, depth+1, path, valueHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.putInner(left, right), nil
+}
+
+// split builds the inner nodes joining two leaves from depth down to the first bit where
+// their paths differ.
+func (t *Tree) split(a, pathA, b, pathB []byte, depth int) []byte {
+	bitA, bitB := bit(pathA, depth), bit(pathB, depth)
+	switch {
+	case bitA != bitB && bitA == 0:
+		return t.putInner(a, b)
+	case bitA != bitB:
+		return t.putInner(b, a)
+	case bitA == 0:
+		return t.putInner(t.split(a, pathA, b, pathB, depth+1), emptyHash)
+	default:
+		return t.putInner(emptyHash, t.split(a, pathA, b, pathB, depth+1))
+	}
+}
+
+func (t *Tree) remove(node []byte, depth int, path []byte) ([]byte, error) {
+	if isEmpty(node) {
+		return node, nil
+	}
+	data, err := t.getNode(node)
+	if err != nil {
+		return nil, err
+	}
+	if isLeaf(data) {
+		if leafPath, _ := leafFields(data); bytes.Equal(leafPath, path) {
+			return emptyHash, nil
+		}
+		return node, nil
+	}
+
+	left, right := innerFields(data)
+	if bit(path, depth) == 0 {
+		left, err = t.remove(left, depth+1, path)
+	} else {
+		right, err = t.remove(right, depth+1, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A leaf left alone in this subtree moves up to take its place.
+	switch {
+	case isEmpty(left) && isEmpty(right):
+		return emptyHash, nil
+	case isEmpty(left):
+		if ok, err := t.isLeafNode(right); err != nil || ok {
+			return right, err
+		}
+	case isEmpty(right):
+		if ok, err := t.isLeafNode(left); err != nil || ok {
+			return left, err
+		}
+	}
+	return t.putInner(left, right), nil
+}
+
+func (t *Tree) isLeafNode(hash []byte) (bool, error) {
+	data, err := t.getNode(hash)
+	if err != nil {
+		return false, err
+	}
+	return isLeaf(data), nil
+}
+
+func (t *Tree) getNode(hash []byte) ([]byte, error) {
+	if data, ok := t.pending[string(hash)]; ok {
+		return data, nil
+	}
+	data, err := t.db.Get(nodeKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: %X", errMissingNode, hash)
+	}
+	t.loaded[string(hash)] = true
+	return data, nil
+}
+
+func (t *Tree) putLeaf(path, valueHash []byte) []byte {
+	return t.putNode(concat(leafPrefix, path, valueHash))
+}
+
+func (t *Tree) putInner(left, right []byte) []byte {
+	return t.putNode(concat(innerPrefix, left, right))
+}
+
+func (t *Tree) putNode(data []byte) []byte {
+	hash := digest(data)
+	t.pending[string(hash)] = data
+	return hash
+}
+
+func nodeKey(hash []byte) []byte {
+	return concat(nodePrefix, hash)
+}
+
+func isEmpty(hash []byte) bool {
+	return bytes.Equal(hash, emptyHash)
+}
+
+func isLeaf(data []byte) bool {
+	return data[0] == leafPrefix[0]
+}
+
+func leafFields(data []byte) (path, valueHash []byte) {
+	return data[1 : 1+hashSize], data[1+hashSize:]
+}
+
+func innerFields(data []byte) (left, right []byte) {
+	return data[1 : 1+hashSize], data[1+hashSize:]
+}
+
+// bit returns the bit of path at the given depth, starting from the most significant bit.
+func bit(path []byte, depth int) byte {
+	return (path[depth/8] >> (7 - depth%8)) & 1
+}
+
+func digest(bz []byte) []byte {
+	h := sha256.Sum256(bz)
+	return h[:]
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
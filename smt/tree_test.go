@@ -0,0 +1,132 @@
+package smt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	db "kvstore/database"
+)
+
+func newTestDB(t *testing.T) *db.PebbleDB {
+	t.Helper()
+	pebble, err := db.NewPebbleDB("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pebble.Close() })
+	return pebble
+}
+
+type op struct {
+	key, value string // an empty value deletes the key
+}
+
+func apply(t *testing.T, tree *Tree, ops []op) {
+	t.Helper()
+	for _, o := range ops {
+		var err error
+		if o.value == "" {
+			err = tree.Delete([]byte(o.key))
+		} else {
+			err = tree.Set([]byte(o.key), []byte(o.value))
+		}
+		if err != nil {
+			t.Fatalf("applying %v: %v", o, err)
+		}
+	}
+}
+
+func TestTreeRootOrderIndependent(t *testing.T) {
+	testCases := []struct {
+		name string
+		a, b []op
+	}{
+		{
+			name: "sets in reverse order",
+			a:    []op{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+			b:    []op{{"c", "3"}, {"b", "2"}, {"a", "1"}},
+		},
+		{
+			name: "overwritten value",
+			a:    []op{{"a", "0"}, {"b", "2"}, {"a", "1"}},
+			b:    []op{{"b", "2"}, {"a", "1"}},
+		},
+		{
+			name: "deleted key",
+			a:    []op{{"a", "1"}, {"x", "9"}, {"b", "2"}, {"x", ""}},
+			b:    []op{{"b", "2"}, {"a", "1"}},
+		},
+		{
+			name: "delete of a missing key",
+			a:    []op{{"a", "1"}, {"missing", ""}},
+			b:    []op{{"a", "1"}},
+		},
+		{
+			name: "everything deleted",
+			a:    []op{{"a", "1"}, {"b", "2"}, {"a", ""}, {"b", ""}},
+			b:    nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pebble := newTestDB(t)
+			a, b := NewTree(pebble, nil), NewTree(pebble, nil)
+			apply(t, a, tc.a)
+			apply(t, b, tc.b)
+			if !bytes.Equal(a.Root(), b.Root()) {
+				t.Fatalf("roots differ: %X and %X", a.Root(), b.Root())
+			}
+			if len(tc.b) == 0 && !bytes.Equal(a.Root(), EmptyRoot()) {
+				t.Fatalf("root of an empty tree is %X, want %X", a.Root(), EmptyRoot())
+			}
+		})
+	}
+}
+
+func TestTreeRootRandomOrder(t *testing.T) {
+	pebble := newTestDB(t)
+	var ops []op
+	for i := 0; i < 200; i++ {
+		ops = append(ops, op{fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)})
+	}
+	want := NewTree(pebble, nil)
+	apply(t, want, ops)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5; i++ {
+		rng.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
+		tree := NewTree(pebble, nil)
+		apply(t, tree, ops)
+		if !bytes.Equal(tree.Root(), want.Root()) {
+			t.Fatalf("shuffle %d: root %X, want %X", i, tree.Root(), want.Root())
+		}
+	}
+}
+
+func TestTreeReopen(t *testing.T) {
+	pebble := newTestDB(t)
+	tree := NewTree(pebble, nil)
+	apply(t, tree, []op{{"a", "1"}, {"b", "2"}, {"c", "3"}})
+	batch := pebble.NewBatch()
+	if err := tree.Write(batch, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates of the reopened tree give the same root as the same updates in memory.
+	reopened := NewTree(pebble, tree.Root())
+	apply(t, reopened, []op{{"b", ""}, {"d", "4"}})
+	apply(t, tree, []op{{"b", ""}, {"d", "4"}})
+	if !bytes.Equal(reopened.Root(), tree.Root()) {
+		t.Fatalf("reopened root %X, want %X", reopened.Root(), tree.Root())
+	}
+
+	// Nodes that were never written cannot be read.
+	if err := NewTree(newTestDB(t), tree.Root()).Set([]byte("a"), []byte("x")); err == nil {
+		t.Fatal("expected an error for a missing node")
+	}
+}
@@ -0,0 +1,124 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+// Format is the snapshot format produced and restored by this application. A snapshot is a
+// stream of key/value records, each encoded as uvarint(len(key)) | key | uvarint(len(value)) |
+// value, split into chunks at arbitrary byte boundaries.
+const Format uint32 = 1
+
+var (
+	ErrUnknownFormat = errors.New("unknown snapshot format")
+	ErrInvalidChunk  = errors.New("invalid snapshot chunk")
+	ErrChunkHash     = errors.New("snapshot chunk hash mismatch")
+)
+
+// Export encodes the key/value pairs of itr and splits them into chunks of at most chunkSize
+// bytes. There is always at least one chunk, which is empty if itr is.
+func Export(itr db.Iterator, chunkSize int) ([][]byte, error) {
+	defer itr.Close()
+
+	var stream []byte
+	for ; itr.Valid(); itr.Next() {
+		key, value := itr.Key(), itr.Value()
+		stream = binary.AppendUvarint(stream, uint64(len(key)))
+		stream = append(stream, key...)
+		stream = binary.AppendUvarint(stream, uint64(len(value)))
+		stream = append(stream, value...)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+
+	chunks := [][]byte{}
+	for len(stream) > chunkSize {
+		chunks = append(chunks, stream[:chunkSize])
+		stream = stream[chunkSize:]
+	}
+	return append(chunks, stream), nil
+}
+
+// Restorer decodes the chunks of a snapshot being restored. Chunks must be applied in order.
+type Restorer struct {
+	Snapshot *abcitypes.Snapshot
+	metadata Metadata
+	next     uint32
+	buf      []byte
+}
+
+// NewRestorer checks an offered snapshot and prepares its restore.
+func NewRestorer(snapshot *abcitypes.Snapshot) (*Restorer, error) {
+	if snapshot.Format != Format {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownFormat, snapshot.Format)
+	}
+	var metadata Metadata
+	if err := json.Unmarshal(snapshot.Metadata, &metadata); err != nil {
+		return nil, fmt.Errorf("decoding snapshot metadata: %w", err)
+	}
+	if snapshot.Chunks == 0 || int(snapshot.Chunks) != len(metadata.ChunkHashes) {
+		return nil, fmt.Errorf("snapshot has %d chunks but %d chunk hashes", snapshot.Chunks, len(metadata.ChunkHashes))
+	}
+	if s := (&Snapshot{Metadata: metadata}); !bytes.Equal(s.Hash(), snapshot.Hash) {
+		return nil, fmt.Errorf("snapshot hash %X does not match its chunk hashes", snapshot.Hash)
+	}
+	return &Restorer{Snapshot: snapshot, metadata: metadata}, nil
+}
+
+// Apply checks the chunk with the given index against its hash and calls fn for every
+// key/value pair it completes, the pair is only valid during the call. It returns true once the
+// last chunk has been applied.
+func (r *Restorer) Apply(index uint32, chunk []byte, fn func(key, value []byte) error) (bool, error) {
+	if index != r.next {
+		return false, fmt.Errorf("%w: expected chunk %d, got %d", ErrInvalidChunk, r.next, index)
+	}
+	if hash := sha256.Sum256(chunk); !bytes.Equal(hash[:], r.metadata.ChunkHashes[index]) {
+		return false, fmt.Errorf("%w: chunk %d", ErrChunkHash, index)
+	}
+	r.next++
+
+	r.buf = append(r.buf, chunk...)
+	for {
+		key, value, n := decodeRecord(r.buf)
+		if n == 0 {
+			break
+		}
+		if err := fn(key, value); err != nil {
+			return false, err
+		}
+		r.buf = r.buf[n:]
+	}
+
+	done := r.next == r.Snapshot.Chunks
+	if done && len(r.buf) != 0 {
+		return false, fmt.Errorf("%w: %d trailing bytes", ErrInvalidChunk, len(r.buf))
+	}
+	return done, nil
+}
+
+// decodeRecord decodes the record at the start of buf. It returns n == 0 if buf does not hold
+// a complete record.
+func decodeRecord(buf []byte) (key, value []byte, n int) {
+	keyLen, i := binary.Uvarint(buf)
+	if i <= 0 || uint64(len(buf)-i) < keyLen {
+		return nil, nil, 0
+	}
+	key = buf[i : i+int(keyLen)]
+	n = i + int(keyLen)
+	valueLen, i := binary.Uvarint(buf[n:])
+	if i <= 0 || uint64(len(buf)-n-i) < valueLen {
+		return nil, nil, 0
+	}
+	value = buf[n+i : n+i+int(valueLen)]
+	return key, value, n + i + int(valueLen)
+}
@@ -0,0 +1,211 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+// exportTestChunks exports n key/value pairs in chunks of chunkSize bytes.
+func exportTestChunks(t *testing.T, n, chunkSize int) [][]byte {
+	t.Helper()
+	pebble, err := db.NewPebbleDB("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pebble.Close()
+	for i := 0; i < n; i++ {
+		if err := pebble.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	itr, err := pebble.Iterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := Export(itr, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+// offer returns the snapshot advertising chunks.
+func offer(t *testing.T, chunks [][]byte) *abcitypes.Snapshot {
+	t.Helper()
+	s := &Snapshot{Height: 1, Format: Format}
+	for _, chunk := range chunks {
+		hash := sha256.Sum256(chunk)
+		s.Metadata.ChunkHashes = append(s.Metadata.ChunkHashes, hash[:])
+	}
+	abci, err := s.ABCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abci
+}
+
+// restore applies chunks in order and returns the restored pairs.
+func restore(snapshot *abcitypes.Snapshot, chunks [][]byte) (map[string]string, error) {
+	r, err := NewRestorer(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	pairs := map[string]string{}
+	for i, chunk := range chunks {
+		done, err := r.Apply(uint32(i), chunk, func(key, value []byte) error {
+			pairs[string(key)] = string(value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if done != (i == len(chunks)-1) {
+			return nil, fmt.Errorf("chunk %d: done is %v", i, done)
+		}
+	}
+	return pairs, nil
+}
+
+func TestExportRestore(t *testing.T) {
+	testCases := []struct {
+		name         string
+		n, chunkSize int
+		chunks       int
+	}{
+		{name: "empty", n: 0, chunkSize: 10, chunks: 1},
+		{name: "one chunk", n: 3, chunkSize: 1000, chunks: 1},
+		{name: "records split across chunks", n: 20, chunkSize: 7, chunks: 39},
+		{name: "one byte chunks", n: 2, chunkSize: 1, chunks: 26},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := exportTestChunks(t, tc.n, tc.chunkSize)
+			if len(chunks) != tc.chunks {
+				t.Fatalf("exported %d chunks, want %d", len(chunks), tc.chunks)
+			}
+			pairs, err := restore(offer(t, chunks), chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pairs) != tc.n {
+				t.Fatalf("restored %d pairs, want %d", len(pairs), tc.n)
+			}
+			for i := 0; i < tc.n; i++ {
+				if got, want := pairs[fmt.Sprintf("key%02d", i)], fmt.Sprintf("value%d", i); got != want {
+					t.Fatalf("restored key%02d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreInvalidChunks(t *testing.T) {
+	chunks := exportTestChunks(t, 5, 16)
+	last := len(chunks) - 1
+
+	testCases := []struct {
+		name string
+		// offered and applied return the chunks advertised by the snapshot and the chunks applied.
+		offered, applied func() [][]byte
+		err              error
+	}{
+		{
+			name: "bad chunk hash",
+			applied: func() [][]byte {
+				applied := clone(chunks)
+				applied[1][0] ^= 1
+				return applied
+			},
+			err: ErrChunkHash,
+		},
+		{
+			name: "truncated chunk",
+			offered: func() [][]byte {
+				offered := clone(chunks)
+				offered[last] = offered[last][:len(offered[last])-1]
+				return offered
+			},
+			err: ErrInvalidChunk,
+		},
+		{
+			name: "trailing bytes",
+			offered: func() [][]byte {
+				offered := clone(chunks)
+				offered[last] = append(offered[last], 3, 'k')
+				return offered
+			},
+			err: ErrInvalidChunk,
+		},
+		{
+			name: "out of order chunks",
+			applied: func() [][]byte {
+				applied := clone(chunks)
+				applied[0], applied[1] = applied[1], applied[0]
+				return applied
+			},
+			err: ErrChunkHash,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			offered := chunks
+			if tc.offered != nil {
+				offered = tc.offered()
+			}
+			applied := offered
+			if tc.applied != nil {
+				applied = tc.applied()
+			}
+			_, err := restore(offer(t, offered), applied)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+
+	// Chunks are applied by index, in order.
+	r, err := NewRestorer(offer(t, chunks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Apply(1, chunks[1], func(_, _ []byte) error { return nil }); !errors.Is(err, ErrInvalidChunk) {
+		t.Fatalf("expected %v for chunk 1 applied first, got %v", ErrInvalidChunk, err)
+	}
+}
+
+func TestNewRestorerInvalidSnapshot(t *testing.T) {
+	chunks := exportTestChunks(t, 5, 16)
+
+	testCases := []struct {
+		name   string
+		modify func(s *abcitypes.Snapshot)
+	}{
+		{name: "unknown format", modify: func(s *abcitypes.Snapshot) { s.Format++ }},
+		{name: "wrong hash", modify: func(s *abcitypes.Snapshot) { s.Hash[0] ^= 1 }},
+		{name: "wrong chunk count", modify: func(s *abcitypes.Snapshot) { s.Chunks++ }},
+		{name: "invalid metadata", modify: func(s *abcitypes.Snapshot) { s.Metadata = []byte("{") }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := offer(t, chunks)
+			tc.modify(s)
+			if _, err := NewRestorer(s); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func clone(chunks [][]byte) [][]byte {
+	out := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		out[i] = append([]byte{}, chunk...)
+	}
+	return out
+}
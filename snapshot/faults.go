@@ -0,0 +1,68 @@
+package snapshot
+
+import (
+	"fmt"
+
+	db "kvstore/database"
+)
+
+// Fault makes a node take or serve faulty snapshots, to test how state sync reacts to them.
+type Fault string
+
+const (
+	// FaultNone serves correct snapshots.
+	FaultNone Fault = ""
+
+	// FaultBadChunkHash serves chunks with a flipped byte, so they do not match their hash.
+	FaultBadChunkHash Fault = "bad-chunk-hash"
+
+	// FaultTruncatedChunk serves chunks cut to half of their size.
+	FaultTruncatedChunk Fault = "truncated-chunk"
+
+	// FaultAppHashMismatch takes snapshots whose values differ from the state, with chunk
+	// hashes matching the altered chunks. Their restore completes with a different app hash.
+	FaultAppHashMismatch Fault = "app-hash-mismatch"
+)
+
+func ParseFault(s string) (Fault, error) {
+	switch f := Fault(s); f {
+	case FaultNone, FaultBadChunkHash, FaultTruncatedChunk, FaultAppHashMismatch:
+		return f, nil
+	default:
+		return FaultNone, fmt.Errorf("unknown snapshot fault %q", s)
+	}
+}
+
+// Chunk returns the chunk as it is served under the fault.
+func (f Fault) Chunk(chunk []byte) []byte {
+	switch f {
+	case FaultBadChunkHash:
+		if len(chunk) == 0 {
+			return []byte{0}
+		}
+		bad := append([]byte{}, chunk...)
+		bad[len(bad)/2] ^= 0xFF
+		return bad
+	case FaultTruncatedChunk:
+		return chunk[:len(chunk)/2]
+	default:
+		return chunk
+	}
+}
+
+// Iterator returns the iterator a snapshot is taken from under the fault.
+func (f Fault) Iterator(itr db.Iterator) db.Iterator {
+	if f == FaultAppHashMismatch {
+		return alteredIterator{itr}
+	}
+	return itr
+}
+
+// alteredIterator appends a byte to every value of the underlying iterator.
+type alteredIterator struct {
+	db.Iterator
+}
+
+func (itr alteredIterator) Value() []byte {
+	return append(itr.Iterator.Value(), '!')
+}
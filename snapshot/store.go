@@ -0,0 +1,223 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+
+	db "kvstore/database"
+)
+
+const metadataFile = "metadata.json"
+
+var errNotFound = errors.New("snapshot not found")
+
+// Metadata describes a snapshot. It is sent to peers in abcitypes.Snapshot.Metadata, so that
+// every chunk can be checked against its hash when it is applied.
+type Metadata struct {
+	ChunkHashes [][]byte `json:"chunk_hashes"`
+}
+
+// Snapshot is a snapshot held by a Store.
+type Snapshot struct {
+	Height   uint64
+	Format   uint32
+	Metadata Metadata
+}
+
+// Hash returns the hash of the snapshot, the hash of its chunk hashes.
+func (s *Snapshot) Hash() []byte {
+	h := sha256.New()
+	for _, chunkHash := range s.Metadata.ChunkHashes {
+		h.Write(chunkHash)
+	}
+	return h.Sum(nil)
+}
+
+// ABCI returns the snapshot as it is advertised to peers.
+func (s *Snapshot) ABCI() (*abcitypes.Snapshot, error) {
+	bz, err := json.Marshal(s.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &abcitypes.Snapshot{
+		Height:   s.Height,
+		Format:   s.Format,
+		Chunks:   uint32(len(s.Metadata.ChunkHashes)),
+		Hash:     s.Hash(),
+		Metadata: bz,
+	}, nil
+}
+
+// Store keeps snapshots on the filesystem, one directory per snapshot holding its chunks and
+// metadata. A snapshot directory is only visible once it is complete.
+type Store struct {
+	mtx sync.Mutex
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Create takes a snapshot at height in the given format from the key/value pairs of itr,
+// split into chunks of at most chunkSize bytes.
+func (s *Store) Create(height uint64, format uint32, itr db.Iterator, chunkSize int) (*Snapshot, error) {
+	chunks, err := Export(itr, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{Height: height, Format: format}
+	for _, chunk := range chunks {
+		hash := sha256.Sum256(chunk)
+		snapshot.Metadata.ChunkHashes = append(snapshot.Metadata.ChunkHashes, hash[:])
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	tmp, err := os.MkdirTemp(s.dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	for i, chunk := range chunks {
+		if err := os.WriteFile(filepath.Join(tmp, chunkFile(uint32(i))), chunk, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	bz, err := json.Marshal(snapshot.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, metadataFile), bz, 0o644); err != nil {
+		return nil, err
+	}
+	dir := s.snapshotDir(height, format)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// List returns all snapshots in the store, the most recent first.
+func (s *Store) List() ([]*Snapshot, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		height, format, ok := parseSnapshotDir(entry.Name())
+		if !entry.IsDir() || !ok {
+			continue
+		}
+		snapshot, err := s.load(height, format)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Height != snapshots[j].Height {
+			return snapshots[i].Height > snapshots[j].Height
+		}
+		return snapshots[i].Format > snapshots[j].Format
+	})
+	return snapshots, nil
+}
+
+// LoadChunk returns a chunk of a snapshot, or nil if the snapshot or the chunk does not exist.
+func (s *Store) LoadChunk(height uint64, format uint32, index uint32) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	chunk, err := os.ReadFile(filepath.Join(s.snapshotDir(height, format), chunkFile(index)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return chunk, err
+}
+
+// Prune deletes all but the keepRecent most recent snapshot heights.
+func (s *Store) Prune(keepRecent int) error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	heights := 0
+	for i, snapshot := range snapshots {
+		if i == 0 || snapshot.Height != snapshots[i-1].Height {
+			heights++
+		}
+		if heights <= keepRecent {
+			continue
+		}
+		if err := os.RemoveAll(s.snapshotDir(snapshot.Height, snapshot.Format)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) load(height uint64, format uint32) (*Snapshot, error) {
+	bz, err := os.ReadFile(filepath.Join(s.snapshotDir(height, format), metadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: height %d, format %d", errNotFound, height, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Height: height, Format: format}
+	if err := json.Unmarshal(bz, &snapshot.Metadata); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *Store) snapshotDir(height uint64, format uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d-%d", height, format))
+}
+
+func parseSnapshotDir(name string) (height uint64, format uint32, ok bool) {
+	h, f, found := strings.Cut(name, "-")
+	if !found {
+		return 0, 0, false
+	}
+	height, err := strconv.ParseUint(h, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	f64, err := strconv.ParseUint(f, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return height, uint32(f64), true
+}
+
+func chunkFile(index uint32) string {
+	return fmt.Sprintf("chunk-%06d", index)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	db "kvstore/database"
+	"kvstore/smt"
+)
+
+var (
+	// stateKey is the key under which the last committed state is stored.
+	stateKey = []byte("meta/state")
+
+	// appHashPrefix is the key prefix under which the app hash of every retained height is
+	// stored, to serve queries at past heights.
+	appHashPrefix = []byte("meta/hash/")
+
+	// finalizedKey is the key under which the height of the block finalized but not yet
+	// committed is stored. It is deleted by the batch committing the block.
+	finalizedKey = []byte("meta/finalized")
+
+	// retainHeightKey is the key under which the last retain height returned by Commit is
+	// stored, see retainHeight.
+	retainHeightKey = []byte("meta/retain")
+
+	// initialHeightKey is the key under which the initial height of the chain is stored, the
+	// height of its first block.
+	initialHeightKey = []byte("meta/initial_height")
+)
+
+// appState is the application state recorded at the end of each committed block. It is
+// written in the same batch as the block, so it always matches the stored key/value pairs.
+type appState struct {
+	Height  int64  `json:"height"`
+	AppHash []byte `json:"app_hash"`
+}
+
+func loadState(db db.DB) (appState, error) {
+	state := appState{AppHash: smt.EmptyRoot()}
+	bz, err := db.Get(stateKey)
+	if err != nil || bz == nil {
+		return state, err
+	}
+	err = json.Unmarshal(bz, &state)
+	return state, err
+}
+
+func (s appState) save(batch db.Batch) error {
+	bz, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := batch.Set(appHashKey(s.Height), s.AppHash); err != nil {
+		return err
+	}
+	return batch.Set(stateKey, bz)
+}
+
+// loadFinalizedHeight returns the height of the block finalized but not committed before the
+// application stopped, or 0 if there is none.
+func loadFinalizedHeight(db db.DB) (int64, error) {
+	bz, err := db.Get(finalizedKey)
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(bz)), nil
+}
+
+// loadRetainHeight returns the last retain height returned by Commit, or 0 if there is none.
+func loadRetainHeight(db db.DB) (int64, error) {
+	bz, err := db.Get(retainHeightKey)
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(bz)), nil
+}
+
+// loadInitialHeight returns the initial height of the chain stored by InitChain, or 1 if the
+// chain is not initialized.
+func loadInitialHeight(db db.DB) (int64, error) {
+	bz, err := db.Get(initialHeightKey)
+	if err != nil || bz == nil {
+		return 1, err
+	}
+	return int64(binary.BigEndian.Uint64(bz)), nil
+}
+
+func appHashKey(height int64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, appHashPrefix...), uint64(height))
+}
+
+// loadAppHash returns the app hash committed at height, or nil if the height is not retained.
+func loadAppHash(db db.DB, height int64) ([]byte, error) {
+	return db.Get(appHashKey(height))
+}
+
+// stateWriter applies writes to the versioned store and to the tree, in the same batch. Its
+// reads see its writes if the store reads from the batch.
+type stateWriter struct {
+	store   *db.VersionedDB
+	batch   db.Batch
+	tree    *smt.Tree
+	version int64
+}
+
+func (w *stateWriter) Get(key []byte) ([]byte, error) {
+	return w.store.Get(key, w.version)
+}
+
+func (w *stateWriter) Set(key, value []byte) error {
+	if err := w.store.Set(w.batch, key, value, w.version); err != nil {
+		return err
+	}
+	return w.tree.Set(key, value)
+}
+
+func (w *stateWriter) Delete(key []byte) error {
+	if err := w.store.Delete(w.batch, key, w.version); err != nil {
+		return err
+	}
+	return w.tree.Delete(key)
+}
+
+// finish adds the new tree nodes to the batch and returns the resulting app hash.
+func (w *stateWriter) finish() ([]byte, error) {
+	if err := w.tree.Write(w.batch, w.version); err != nil {
+		return nil, err
+	}
+	return w.tree.Root(), nil
+}
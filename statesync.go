@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+
+	db "kvstore/database"
+	"kvstore/smt"
+	"kvstore/snapshot"
+)
+
+// restore is a state sync restore in progress. The restored state is collected in the batch of
+// w and only written once all chunks have been applied and the app hash has been checked.
+type restore struct {
+	restorer *snapshot.Restorer
+	appHash  []byte
+	w        *stateWriter
+}
+
+func (cfg Config) validateSnapshots() error {
+	// Chunks are cut in the background snapshot goroutine, which must never spin or panic.
+	if cfg.SnapshotChunkSize <= 0 {
+		return errors.New("snapshot_chunk_size must be positive")
+	}
+	// Pruning runs right after a snapshot is created, and must keep it.
+	if cfg.SnapshotKeepRecent <= 0 {
+		return errors.New("snapshot_keep_recent must be positive")
+	}
+	return nil
+}
+
+// maybeSnapshot takes a snapshot of the state at height in the background if height is a
+// snapshot height. Snapshots are skipped while the previous one is still being taken.
+func (app *KVStoreApplication) maybeSnapshot(height int64) {
+	interval := app.cfg.SnapshotInterval
+	if interval == 0 || uint64(height)%interval != 0 {
+		return
+	}
+	if !app.snapshotting.CompareAndSwap(false, true) {
+		app.logger.Info("snapshot", "msg", "skipping snapshot, previous one still in progress", "height", height)
+		return
+	}
+
+	// The iterator reads the state at height even as later blocks are committed.
+	itr, err := app.store.Iterator(nil, nil, height)
+	if err != nil {
+		app.snapshotting.Store(false)
+		app.logger.Error("snapshot", "msg", "error creating iterator", "height", height, "err", err)
+		return
+	}
+	go func() {
+		defer app.snapshotting.Store(false)
+		fault := app.cfg.SnapshotFault
+		s, err := app.snapshots.Create(uint64(height), app.cfg.SnapshotFormat, fault.Iterator(itr), app.cfg.SnapshotChunkSize)
+		if err != nil {
+			app.logger.Error("snapshot", "msg", "error creating snapshot", "height", height, "err", err)
+			return
+		}
+		app.logger.Info("snapshot", "msg", "snapshot created", "height", height, "format", s.Format,
+			"chunks", len(s.Metadata.ChunkHashes), "fault", fault)
+		if err := app.snapshots.Prune(app.cfg.SnapshotKeepRecent); err != nil {
+			app.logger.Error("snapshot", "msg", "error pruning snapshots", "err", err)
+		}
+	}()
+}
+
+// clearState adds to the batch the deletes of the state a restored snapshot replaces: the
+// versions of the key/value pairs, the tree nodes and the app hashes. A node runs InitChain
+// before state sync, and the snapshot does not overwrite the genesis keys deleted since.
+func (app *KVStoreApplication) clearState(batch db.Batch) error {
+	if err := app.store.Clear(batch); err != nil {
+		return err
+	}
+	if err := smt.Clear(app.db, batch); err != nil {
+		return err
+	}
+	return db.DeletePrefix(app.db, batch, appHashPrefix)
+}
+
+func (app *KVStoreApplication) abortRestore() {
+	if app.restore == nil {
+		return
+	}
+	if err := app.restore.w.batch.Close(); err != nil {
+		app.logger.Error("snapshot", "msg", "error closing restore batch", "err", err)
+	}
+	app.restore = nil
+}
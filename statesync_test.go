@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+
+	db "kvstore/database"
+	"kvstore/snapshot"
+)
+
+// restoreSnapshot restores on target the snapshot of source at height.
+func restoreSnapshot(t *testing.T, source, target *KVStoreApplication, height int64) {
+	t.Helper()
+	offer, apply := syncSnapshot(t, source, target, height)
+	if offer.Result != abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT {
+		t.Fatalf("snapshot offer result %v", offer.Result)
+	}
+	if apply.Result != abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT {
+		t.Fatalf("chunk apply result %v", apply.Result)
+	}
+}
+
+// syncSnapshot offers target the snapshot source takes at height with its snapshot format and
+// fault, and applies the chunks source serves until one is not accepted. It returns the
+// response to the offer and the response to the last chunk applied, nil if none was.
+func syncSnapshot(t *testing.T, source, target *KVStoreApplication, height int64) (*abcitypes.OfferSnapshotResponse, *abcitypes.ApplySnapshotChunkResponse) {
+	t.Helper()
+	itr, err := source.store.Iterator(nil, nil, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := source.snapshots.Create(uint64(height), source.cfg.SnapshotFormat, source.cfg.SnapshotFault.Iterator(itr), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abciSnapshot, err := s.ABCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appHash, err := loadAppHash(source.db, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	offer, err := target.OfferSnapshot(ctx, &abcitypes.OfferSnapshotRequest{Snapshot: abciSnapshot, AppHash: appHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.Result != abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT {
+		return offer, nil
+	}
+	var apply *abcitypes.ApplySnapshotChunkResponse
+	for i := uint32(0); i < abciSnapshot.Chunks; i++ {
+		chunk, err := source.LoadSnapshotChunk(ctx, &abcitypes.LoadSnapshotChunkRequest{Height: uint64(height), Format: s.Format, Chunk: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		apply, err = target.ApplySnapshotChunk(ctx, &abcitypes.ApplySnapshotChunkRequest{Index: i, Chunk: chunk.Chunk, Sender: "source"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apply.Result != abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT {
+			break
+		}
+	}
+	return offer, apply
+}
+
+func TestRestoreReplacesGenesisState(t *testing.T) {
+	val1, val2 := ed25519.GenPrivKey().PubKey().Bytes(), ed25519.GenPrivKey().PubKey().Bytes()
+	genesisVals := []abcitypes.ValidatorUpdate{abcitypes.UpdateValidator(val1, 10, ed25519.KeyType)}
+	const genesis = `{"kvs": {"g": "1", "h": "1"}}`
+
+	source := newTestApp(t, DefaultConfig())
+	initChain(t, source, genesis, genesisVals...)
+	commitBlock(t, source, 1, "a=1", fmt.Sprintf("val:%s!10", base64.StdEncoding.EncodeToString(val2)))
+	commitBlock(t, source, 2, "del:g", fmt.Sprintf("val:%s!0", base64.StdEncoding.EncodeToString(val1)))
+
+	// The restoring node ran InitChain with the same genesis, and holds keys the snapshot does not.
+	target := newTestApp(t, DefaultConfig())
+	initChain(t, target, genesis, genesisVals...)
+	restoreSnapshot(t, source, target, 2)
+
+	if target.state.Height != 2 || !bytes.Equal(target.state.AppHash, source.state.AppHash) {
+		t.Fatalf("restored state %+v, want %+v", target.state, source.state)
+	}
+	want, got := storeContents(t, source, 2), storeContents(t, target, db.LatestVersion)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("restored store %q, want %q", got, want)
+	}
+	vals, err := target.loadValidators(db.LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vals[string(val2)]; !ok || len(vals) != 1 {
+		t.Fatalf("restored %d validators, want only the one added at height 1", len(vals))
+	}
+
+	// The genesis state is gone from the past versions too.
+	if value, err := target.store.Get([]byte("g"), 0); err != nil || value != nil {
+		t.Fatalf("genesis value of g = %q, %v after the restore", value, err)
+	}
+	if appHash, err := loadAppHash(target.db, 0); err != nil || appHash != nil {
+		t.Fatalf("genesis app hash %X, %v after the restore", appHash, err)
+	}
+
+	// The restored node executes the next block like the source.
+	for _, app := range []*KVStoreApplication{source, target} {
+		if results := commitBlock(t, app, 3, "cas:g==2", "inc:h=1"); results[0].Code != codeTypeOK || results[1].Code != codeTypeOK {
+			t.Fatalf("results %v", results)
+		}
+	}
+	if !bytes.Equal(target.state.AppHash, source.state.AppHash) {
+		t.Fatalf("app hash %X after the restore, want %X", target.state.AppHash, source.state.AppHash)
+	}
+}
+
+func TestSnapshotFaults(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     func(cfg *Config)
+		offer   abcitypes.OfferSnapshotResult
+		apply   abcitypes.ApplySnapshotChunkResult // if the offer is accepted
+		refetch bool                               // whether the first chunk is refetched from another sender
+	}{
+		{
+			name:  "none",
+			cfg:   func(cfg *Config) {},
+			offer: abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT,
+			apply: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT,
+		},
+		{
+			name:  "unknown format",
+			cfg:   func(cfg *Config) { cfg.SnapshotFormat = snapshot.Format + 1 },
+			offer: abcitypes.OFFER_SNAPSHOT_RESULT_REJECT_FORMAT,
+		},
+		{
+			name:    "bad chunk hash",
+			cfg:     func(cfg *Config) { cfg.SnapshotFault = snapshot.FaultBadChunkHash },
+			offer:   abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT,
+			apply:   abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_RETRY,
+			refetch: true,
+		},
+		{
+			name:    "truncated chunk",
+			cfg:     func(cfg *Config) { cfg.SnapshotFault = snapshot.FaultTruncatedChunk },
+			offer:   abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT,
+			apply:   abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_RETRY,
+			refetch: true,
+		},
+		{
+			name:  "app hash mismatch",
+			cfg:   func(cfg *Config) { cfg.SnapshotFault = snapshot.FaultAppHashMismatch },
+			offer: abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT,
+			apply: abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ABORT,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			source := newTestApp(t, cfg)
+			initChain(t, source, `{"kvs": {"g": "1"}}`)
+			commitBlock(t, source, 1, "a=1", "b=2")
+
+			target := newTestApp(t, DefaultConfig())
+			initChain(t, target, `{"kvs": {"g": "1"}}`)
+			offer, apply := syncSnapshot(t, source, target, 1)
+			if offer.Result != tc.offer {
+				t.Fatalf("snapshot offer result %v, want %v", offer.Result, tc.offer)
+			}
+			if tc.offer != abcitypes.OFFER_SNAPSHOT_RESULT_ACCEPT {
+				return
+			}
+			if apply.Result != tc.apply {
+				t.Fatalf("chunk apply result %v, want %v", apply.Result, tc.apply)
+			}
+			if tc.refetch {
+				if fmt.Sprint(apply.RefetchChunks) != "[0]" || fmt.Sprint(apply.RejectSenders) != "[source]" {
+					t.Fatalf("refetching chunks %v, rejecting senders %v, want chunk 0 and the source", apply.RefetchChunks, apply.RejectSenders)
+				}
+			}
+
+			// Only a complete and correct snapshot changes the state of the target.
+			wantHeight := int64(0)
+			if tc.apply == abcitypes.APPLY_SNAPSHOT_CHUNK_RESULT_ACCEPT {
+				wantHeight = 1
+			}
+			if target.state.Height != wantHeight {
+				t.Fatalf("target height %d after the restore, want %d", target.state.Height, wantHeight)
+			}
+		})
+	}
+}
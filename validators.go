@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	"github.com/cometbft/cometbft/crypto/secp256k1"
+	cmttypes "github.com/cometbft/cometbft/types"
+
+	db "kvstore/database"
+)
+
+// validatorTxPrefix starts the transactions that update the validator set. They have the form
+// val:<base64 public key>!<power>, and a power of zero removes the validator.
+const validatorTxPrefix = "val:"
+
+var (
+	// reservedPrefix starts the keys holding application state other than the key/value pairs
+	// written by transactions. Transactions cannot write keys with this prefix.
+	reservedPrefix = []byte("_")
+
+	// validatorPrefix is the key prefix under which the validators are stored, by public key.
+	validatorPrefix = []byte("_val/")
+
+	// validatorSetPrefix is the key prefix under which the validator set is stored by the height it
+	// applies from, see saveValidatorSet.
+	validatorSetPrefix = []byte("_valset/")
+)
+
+func isValidatorTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(validatorTxPrefix))
+}
+
+// parseValidatorTx parses a validator transaction.
+func parseValidatorTx(tx []byte) (abcitypes.ValidatorUpdate, error) {
+	pubKeyStr, powerStr, ok := strings.Cut(string(tx[len(validatorTxPrefix):]), "!")
+	if !ok {
+		return abcitypes.ValidatorUpdate{}, errors.New("expected val:<base64 public key>!<power>")
+	}
+	pubKey, err := base64.StdEncoding.DecodeString(pubKeyStr)
+	if err != nil {
+		return abcitypes.ValidatorUpdate{}, fmt.Errorf("decoding public key: %w", err)
+	}
+	power, err := strconv.ParseInt(powerStr, 10, 64)
+	if err != nil {
+		return abcitypes.ValidatorUpdate{}, fmt.Errorf("parsing power: %w", err)
+	}
+	return newValidatorUpdate(pubKey, power)
+}
+
+// newValidatorUpdate returns the update of the validator with the given public key to power.
+// The key type is inferred from the size of the public key.
+func newValidatorUpdate(pubKey []byte, power int64) (abcitypes.ValidatorUpdate, error) {
+	if power < 0 || power > cmttypes.MaxTotalVotingPower {
+		return abcitypes.ValidatorUpdate{}, fmt.Errorf("power %d is out of bounds", power)
+	}
+
+	switch len(pubKey) {
+	case ed25519.PubKeySize:
+		return abcitypes.UpdateValidator(pubKey, power, ed25519.KeyType), nil
+	case secp256k1.PubKeySize:
+		return abcitypes.UpdateValidator(pubKey, power, secp256k1.KeyType), nil
+	default:
+		return abcitypes.ValidatorUpdate{}, fmt.Errorf("public key of %d bytes is neither ed25519 nor secp256k1", len(pubKey))
+	}
+}
+
+// checkValidatorTx checks a validator transaction against the committed validator set.
+func (app *KVStoreApplication) checkValidatorTx(tx []byte) (uint32, error) {
+	val, err := parseValidatorTx(tx)
+	if err != nil {
+		return codeTypeInvalidValidatorTx, err
+	}
+	vals, err := app.loadValidators(db.LatestVersion)
+	if err != nil {
+		app.logger.Error("abci", "method", "CheckTx", "msg", "error loading validators", "err", err)
+		return codeTypeInternalError, errors.New("error loading validators")
+	}
+	params, err := app.loadConsensusParams(db.LatestVersion)
+	if err != nil {
+		app.logger.Error("abci", "method", "CheckTx", "msg", "error loading consensus params", "err", err)
+		return codeTypeInternalError, errors.New("error loading consensus params")
+	}
+	if err := vals.check(val, params.GetValidator().GetPubKeyTypes()); err != nil {
+		return codeTypeInvalidValidatorTx, err
+	}
+	return codeTypeOK, nil
+}
+
+// validatorSet is the validator set stored by the application, indexed by public key.
+type validatorSet map[string]abcitypes.ValidatorUpdate
+
+func (app *KVStoreApplication) loadValidators(version int64) (validatorSet, error) {
+	itr, err := app.store.PrefixIterator(validatorPrefix, version)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	vals := validatorSet{}
+	for ; itr.Valid(); itr.Next() {
+		var val abcitypes.ValidatorUpdate
+		if err := val.Unmarshal(itr.Value()); err != nil {
+			return nil, err
+		}
+		vals[string(itr.Key()[len(validatorPrefix):])] = val
+	}
+	return vals, itr.Error()
+}
+
+// check returns an error if the update cannot be applied to the set. Only the public key types
+// in pubKeyTypes are accepted.
+func (vals validatorSet) check(val abcitypes.ValidatorUpdate, pubKeyTypes []string) error {
+	pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(pubKeyTypes, pubKey.Type()) {
+		return fmt.Errorf("public key type %s is not allowed, expected one of %v", pubKey.Type(), pubKeyTypes)
+	}
+
+	current, ok := vals[string(pubKey.Bytes())]
+	if val.Power == 0 {
+		if !ok {
+			return fmt.Errorf("validator %X is not in the validator set", pubKey.Bytes())
+		}
+		if len(vals) == 1 {
+			return errors.New("cannot remove the last validator")
+		}
+	}
+	var total int64
+	for _, v := range vals {
+		total += v.Power
+	}
+	if total-current.Power+val.Power > cmttypes.MaxTotalVotingPower {
+		return fmt.Errorf("total voting power would exceed %d", cmttypes.MaxTotalVotingPower)
+	}
+	return nil
+}
+
+// apply applies the update to the set and stores it with w.
+func (vals validatorSet) apply(w *stateWriter, val abcitypes.ValidatorUpdate) error {
+	pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+	if err != nil {
+		return err
+	}
+	key := append(append([]byte{}, validatorPrefix...), pubKey.Bytes()...)
+	if val.Power == 0 {
+		delete(vals, string(pubKey.Bytes()))
+		return w.Delete(key)
+	}
+	vals[string(pubKey.Bytes())] = val
+	bz, err := val.Marshal()
+	if err != nil {
+		return err
+	}
+	return w.Set(key, bz)
+}
+
+func validatorSetKey(height int64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, validatorSetPrefix...), uint64(height))
+}
+
+// saveValidatorSet stores with w the set as the validators from height on. Unlike the versions of
+// the validators, the sets are part of the snapshots, so that a restored node can verify the oracle
+// transactions of the heights following the snapshot. The sets that no longer apply at the height
+// of w, or later, are deleted.
+func saveValidatorSet(w *stateWriter, vals validatorSet, height int64) error {
+	itr, err := w.store.Iterator(validatorSetPrefix, validatorSetKey(w.version+1), w.version)
+	if err != nil {
+		return err
+	}
+	var stale [][]byte
+	for ; itr.Valid(); itr.Next() {
+		stale = append(stale, bytes.Clone(itr.Key()))
+	}
+	err = itr.Error()
+	itr.Close()
+	if err != nil {
+		return err
+	}
+	// The last set starting at the height of w or before still applies to it.
+	if len(stale) > 0 {
+		stale = stale[:len(stale)-1]
+	}
+	for _, key := range stale {
+		if err := w.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	bz, err := vals.encode()
+	if err != nil {
+		return err
+	}
+	return w.Set(validatorSetKey(height), bz)
+}
+
+// loadValidatorSet returns the validators of height, stored by saveValidatorSet.
+func (app *KVStoreApplication) loadValidatorSet(height int64) (validatorSet, error) {
+	itr, err := app.store.Iterator(validatorSetPrefix, validatorSetKey(height+1), db.LatestVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var bz []byte
+	for ; itr.Valid(); itr.Next() {
+		bz = bytes.Clone(itr.Value())
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	if bz == nil {
+		return nil, fmt.Errorf("no validator set stored for height %d", height)
+	}
+	return decodeValidatorSet(bz)
+}
+
+// encode encodes the set as the length-prefixed updates of its validators, sorted by public key.
+func (vals validatorSet) encode() ([]byte, error) {
+	pubKeys := make([]string, 0, len(vals))
+	for pubKey := range vals {
+		pubKeys = append(pubKeys, pubKey)
+	}
+	slices.Sort(pubKeys)
+
+	bz := []byte{}
+	for _, pubKey := range pubKeys {
+		val := vals[pubKey]
+		valBz, err := val.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		bz = binary.AppendUvarint(bz, uint64(len(valBz)))
+		bz = append(bz, valBz...)
+	}
+	return bz, nil
+}
+
+func decodeValidatorSet(bz []byte) (validatorSet, error) {
+	vals := validatorSet{}
+	for len(bz) > 0 {
+		size, n := binary.Uvarint(bz)
+		if n <= 0 || size > uint64(len(bz)-n) {
+			return nil, errors.New("malformed validator set")
+		}
+		var val abcitypes.ValidatorUpdate
+		if err := val.Unmarshal(bz[n : n+int(size)]); err != nil {
+			return nil, err
+		}
+		pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		vals[string(pubKey.Bytes())] = val
+		bz = bz[n+int(size):]
+	}
+	return vals, nil
+}
+
+// mergeValidatorUpdates returns the updates with only the last update of every public key, as
+// CometBFT rejects blocks updating a validator twice. vals is the validator set before the
+// updates: the removal of a validator that was not in it, added and removed by the updates, is
+// dropped, as CometBFT fails to remove a validator it does not know.
+func mergeValidatorUpdates(vals validatorSet, updates []abcitypes.ValidatorUpdate) []abcitypes.ValidatorUpdate {
+	known := map[string]bool{}
+	for _, val := range vals {
+		known[val.PubKey.String()] = true
+	}
+	var merged []abcitypes.ValidatorUpdate
+	index := map[string]int{}
+	for _, val := range updates {
+		key := val.PubKey.String()
+		if i, ok := index[key]; ok {
+			merged[i] = val
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, val)
+	}
+	return slices.DeleteFunc(merged, func(val abcitypes.ValidatorUpdate) bool {
+		return val.Power == 0 && !known[val.PubKey.String()]
+	})
+}
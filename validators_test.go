@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	"github.com/cometbft/cometbft/crypto/secp256k1"
+
+	db "kvstore/database"
+)
+
+// powers returns the validators of the updates by name, with their power.
+func powers(t *testing.T, names map[string]string, updates []abcitypes.ValidatorUpdate) string {
+	t.Helper()
+	var vals []string
+	for _, val := range updates {
+		pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals = append(vals, fmt.Sprintf("%s:%d", names[string(pubKey.Bytes())], val.Power))
+	}
+	sort.Strings(vals)
+	return fmt.Sprint(vals)
+}
+
+func TestValidatorTxs(t *testing.T) {
+	keys := map[string][]byte{
+		"a":    ed25519.GenPrivKey().PubKey().Bytes(),
+		"b":    ed25519.GenPrivKey().PubKey().Bytes(),
+		"new":  ed25519.GenPrivKey().PubKey().Bytes(),
+		"secp": secp256k1.GenPrivKey().PubKey().Bytes(),
+	}
+	names := map[string]string{}
+	for name, key := range keys {
+		names[string(key)] = name
+	}
+	val := func(name string, power int64) string {
+		return fmt.Sprintf("val:%s!%d", base64.StdEncoding.EncodeToString(keys[name]), power)
+	}
+
+	testCases := []struct {
+		name    string
+		genesis []string // the names of the genesis validators, of power 10
+		txs     []string
+		codes   []uint32
+		updates string // the merged updates returned by FinalizeBlock
+		vals    string // the validator set after the block
+	}{
+		{
+			name:    "add",
+			genesis: []string{"a"},
+			txs:     []string{val("new", 5)},
+			codes:   []uint32{codeTypeOK},
+			updates: "[new:5]",
+			vals:    "[a:10 new:5]",
+		},
+		{
+			name:    "remove",
+			genesis: []string{"a", "b"},
+			txs:     []string{val("b", 0)},
+			codes:   []uint32{codeTypeOK},
+			updates: "[b:0]",
+			vals:    "[a:10]",
+		},
+		{
+			name:    "remove the last validator",
+			genesis: []string{"a"},
+			txs:     []string{val("a", 0)},
+			codes:   []uint32{codeTypeInvalidValidatorTx},
+			updates: "[]",
+			vals:    "[a:10]",
+		},
+		{
+			name:    "remove an unknown validator",
+			genesis: []string{"a", "b"},
+			txs:     []string{val("new", 0)},
+			codes:   []uint32{codeTypeInvalidValidatorTx},
+			updates: "[]",
+			vals:    "[a:10 b:10]",
+		},
+		{
+			name:    "disallowed key type",
+			genesis: []string{"a"},
+			txs:     []string{val("secp", 5)},
+			codes:   []uint32{codeTypeInvalidValidatorTx},
+			updates: "[]",
+			vals:    "[a:10]",
+		},
+		{
+			name:    "power out of bounds",
+			genesis: []string{"a"},
+			txs:     []string{val("new", -1)},
+			codes:   []uint32{codeTypeInvalidValidatorTx},
+			updates: "[]",
+			vals:    "[a:10]",
+		},
+		{
+			name:    "add then update",
+			genesis: []string{"a"},
+			txs:     []string{val("new", 5), val("new", 7)},
+			codes:   []uint32{codeTypeOK, codeTypeOK},
+			updates: "[new:7]",
+			vals:    "[a:10 new:7]",
+		},
+		{
+			name:    "add then remove",
+			genesis: []string{"a"},
+			txs:     []string{val("new", 5), val("new", 0)},
+			codes:   []uint32{codeTypeOK, codeTypeOK},
+			updates: "[]",
+			vals:    "[a:10]",
+		},
+		{
+			name:    "add, remove and add again",
+			genesis: []string{"a"},
+			txs:     []string{val("new", 5), val("new", 0), val("new", 3)},
+			codes:   []uint32{codeTypeOK, codeTypeOK, codeTypeOK},
+			updates: "[new:3]",
+			vals:    "[a:10 new:3]",
+		},
+		{
+			name:    "remove then add again",
+			genesis: []string{"a", "b"},
+			txs:     []string{val("b", 0), val("b", 4)},
+			codes:   []uint32{codeTypeOK, codeTypeOK},
+			updates: "[b:4]",
+			vals:    "[a:10 b:4]",
+		},
+		{
+			name:    "update then remove",
+			genesis: []string{"a", "b"},
+			txs:     []string{val("b", 4), val("b", 0)},
+			codes:   []uint32{codeTypeOK, codeTypeOK},
+			updates: "[b:0]",
+			vals:    "[a:10]",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var genesisVals []abcitypes.ValidatorUpdate
+			for _, name := range tc.genesis {
+				genesisVals = append(genesisVals, abcitypes.UpdateValidator(keys[name], 10, ed25519.KeyType))
+			}
+			app := newTestApp(t, DefaultConfig())
+			initChain(t, app, `{}`, genesisVals...)
+
+			// CheckTx checks the first transaction against the committed validator set, the
+			// others depend on it.
+			check, err := app.CheckTx(context.Background(), &abcitypes.CheckTxRequest{Tx: []byte(tc.txs[0]), Type: abcitypes.CHECK_TX_TYPE_CHECK})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check.Code != tc.codes[0] {
+				t.Fatalf("CheckTx code %d (%s), want %d", check.Code, check.Log, tc.codes[0])
+			}
+
+			resp := finalizeBlock(t, app, 1, tc.txs...)
+			for i, result := range resp.TxResults {
+				if result.Code != tc.codes[i] {
+					t.Fatalf("tx %d: code %d (%s), want %d", i, result.Code, result.Log, tc.codes[i])
+				}
+			}
+			if updates := powers(t, names, resp.ValidatorUpdates); updates != tc.updates {
+				t.Fatalf("validator updates %s, want %s", updates, tc.updates)
+			}
+			if _, err := app.Commit(context.Background(), &abcitypes.CommitRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			vals, err := app.loadValidators(db.LatestVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var set []abcitypes.ValidatorUpdate
+			for _, val := range vals {
+				set = append(set, val)
+			}
+			if got := powers(t, names, set); got != tc.vals {
+				t.Fatalf("validator set %s, want %s", got, tc.vals)
+			}
+		})
+	}
+}
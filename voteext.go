@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	"github.com/cometbft/cometbft/crypto"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	cmttypes "github.com/cometbft/cometbft/types"
+
+	db "kvstore/database"
+)
+
+const (
+	// oracleTxPrefix starts the transactions injected by proposers to aggregate the vote
+	// extensions of the previous height, of the form oracle:<JSON oracleTx>. They are not accepted
+	// by CheckTx.
+	oracleTxPrefix = "oracle:"
+
+	// maxVoteExtensionSize is the maximum size of a vote extension.
+	maxVoteExtensionSize = 256
+
+	// The simulated price feed reports prices of basePrice ± priceSpread.
+	basePrice   = 100_000
+	priceSpread = 1_000
+)
+
+var (
+	// chainIDKey is the key under which the chain ID is stored, to verify the signatures of
+	// vote extensions and signed transactions. It is loaded in app.chainID.
+	chainIDKey = []byte("_chain_id")
+
+	// oraclePriceKey and oracleHeightKey are the keys under which the last aggregated price and
+	// the height of the vote extensions it was aggregated from are stored.
+	oraclePriceKey  = []byte("_oracle/price")
+	oracleHeightKey = []byte("_oracle/height")
+
+	// errOracleTx is returned by CheckTx for oracle transactions, which only proposers add to
+	// blocks.
+	errOracleTx = errors.New("oracle transactions are only added to blocks by proposers")
+)
+
+// voteExtension is the extension of the precommits of this application. It attests the app hash
+// the validator committed before the height of the vote, and reports a price from a simulated
+// price feed, which differs between validators.
+type voteExtension struct {
+	Height  int64  `json:"height"`
+	AppHash []byte `json:"app_hash"`
+	Price   int64  `json:"price"`
+}
+
+// decodeVoteExtension decodes a vote extension and checks that it is well formed.
+func decodeVoteExtension(bz []byte) (*voteExtension, error) {
+	if len(bz) > maxVoteExtensionSize {
+		return nil, fmt.Errorf("vote extension of %d bytes exceeds the maximum of %d", len(bz), maxVoteExtensionSize)
+	}
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	ext := &voteExtension{}
+	if err := dec.Decode(ext); err != nil {
+		return nil, fmt.Errorf("decoding vote extension: %w", err)
+	}
+	if ext.Price <= 0 {
+		return nil, fmt.Errorf("price %d is not positive", ext.Price)
+	}
+	return ext, nil
+}
+
+// simulatedPrice returns the price reported by the simulated price feed of this node.
+func simulatedPrice() int64 {
+	return basePrice - priceSpread + rand.Int63n(2*priceSpread+1)
+}
+
+// oracleTx aggregates the vote extensions of the precommits of a height. Price is the median of
+// their prices.
+type oracleTx struct {
+	Height int64        `json:"height"`
+	Round  int32        `json:"round"`
+	Price  int64        `json:"price"`
+	Votes  []oracleVote `json:"votes"`
+}
+
+// oracleVote is a vote extension with the address of the validator that signed it.
+type oracleVote struct {
+	Validator []byte `json:"validator"`
+	Extension []byte `json:"extension"`
+	Signature []byte `json:"signature"`
+}
+
+func isOracleTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(oracleTxPrefix))
+}
+
+// wrapsOracleTx reports whether tx is a fee, lane or signed transaction with an oracle
+// transaction inside, at any depth. Oracle transactions are only valid unwrapped, as the first
+// transaction of the block. Signatures are not verified, isValid does it.
+func wrapsOracleTx(tx []byte) bool {
+	var inner []byte
+	switch {
+	case isFeeTx(tx):
+		ftx, err := parseFeeTx(tx)
+		if err != nil {
+			return false
+		}
+		inner = ftx.tx
+	case isLaneTx(tx):
+		ltx, err := parseLaneTx(tx)
+		if err != nil {
+			return false
+		}
+		inner = ltx.tx
+	case isSignedTx(tx):
+		parts := bytes.SplitN(tx[len(signedTxPrefix):], []byte("!"), 4)
+		if len(parts) != 4 {
+			return false
+		}
+		inner = parts[3]
+	default:
+		return false
+	}
+	return isOracleTx(inner) || wrapsOracleTx(inner)
+}
+
+func parseOracleTx(tx []byte) (*oracleTx, error) {
+	dec := json.NewDecoder(bytes.NewReader(tx[len(oracleTxPrefix):]))
+	dec.DisallowUnknownFields()
+	otx := &oracleTx{}
+	if err := dec.Decode(otx); err != nil {
+		return nil, fmt.Errorf("decoding oracle transaction: %w", err)
+	}
+	return otx, nil
+}
+
+// medianPrice returns the lower median of the prices of the vote extensions.
+func medianPrice(exts []*voteExtension) int64 {
+	prices := make([]int64, len(exts))
+	for i, ext := range exts {
+		prices[i] = ext.Price
+	}
+	slices.Sort(prices)
+	return prices[(len(prices)-1)/2]
+}
+
+// voteExtensionsEnabled returns whether the precommits of height carry vote extensions. There
+// are no precommits below height 1, the first block has no last commit.
+func (app *KVStoreApplication) voteExtensionsEnabled(height int64) (bool, error) {
+	if height < 1 {
+		return false, nil
+	}
+	params, err := app.loadConsensusParams(db.LatestVersion)
+	if err != nil {
+		return false, err
+	}
+	return cmttypes.ConsensusParamsFromProto(*params).Feature.VoteExtensionsEnabled(height), nil
+}
+
+// newVoteExtension returns the vote extension of this node at height, attesting the last
+// committed app hash.
+func (app *KVStoreApplication) newVoteExtension(height int64) ([]byte, error) {
+	return json.Marshal(voteExtension{Height: height, AppHash: app.state.AppHash, Price: simulatedPrice()})
+}
+
+// verifyVoteExtension checks the vote extension of a validator at height against the last
+// committed state.
+func (app *KVStoreApplication) verifyVoteExtension(bz []byte, height int64) error {
+	ext, err := decodeVoteExtension(bz)
+	if err != nil {
+		return err
+	}
+	if ext.Height != height {
+		return fmt.Errorf("vote extension is for height %d", ext.Height)
+	}
+	if !bytes.Equal(ext.AppHash, app.state.AppHash) {
+		return fmt.Errorf("vote extension attests app hash %X, expected %X", ext.AppHash, app.state.AppHash)
+	}
+	return nil
+}
+
+// newOracleTx returns the oracle transaction aggregating the vote extensions of the last commit
+// of a proposal at height, or nil if the last commit has no vote extensions.
+func (app *KVStoreApplication) newOracleTx(req *abcitypes.PrepareProposalRequest) ([]byte, error) {
+	if enabled, err := app.voteExtensionsEnabled(req.Height - 1); err != nil || !enabled {
+		return nil, err
+	}
+	otx := oracleTx{Height: req.Height - 1, Round: req.LocalLastCommit.Round}
+	var exts []*voteExtension
+	for _, vote := range req.LocalLastCommit.Votes {
+		if vote.BlockIdFlag != cmtproto.BlockIDFlagCommit {
+			continue
+		}
+		ext, err := decodeVoteExtension(vote.VoteExtension)
+		if err != nil {
+			app.logger.Info("abci", "method", "PrepareProposal", "msg", "skipping invalid vote extension",
+				"validator", fmt.Sprintf("%X", vote.Validator.Address), "err", err)
+			continue
+		}
+		exts = append(exts, ext)
+		otx.Votes = append(otx.Votes, oracleVote{
+			Validator: vote.Validator.Address,
+			Extension: vote.VoteExtension,
+			Signature: vote.ExtensionSignature,
+		})
+	}
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	otx.Price = medianPrice(exts)
+	bz, err := json.Marshal(otx)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(oracleTxPrefix), bz...), nil
+}
+
+// verifyOracleTx checks that the oracle transaction of a proposal at height aggregates vote
+// extensions signed by validators holding more than 2/3 of the voting power of the previous
+// height.
+func (app *KVStoreApplication) verifyOracleTx(tx []byte, height int64) error {
+	otx, err := parseOracleTx(tx)
+	if err != nil {
+		return err
+	}
+	if otx.Height != height-1 {
+		return fmt.Errorf("oracle transaction is for height %d, expected %d", otx.Height, height-1)
+	}
+	if enabled, err := app.voteExtensionsEnabled(otx.Height); err != nil {
+		return err
+	} else if !enabled {
+		return fmt.Errorf("vote extensions are not enabled at height %d", otx.Height)
+	}
+	vals, err := app.loadValidatorSet(otx.Height)
+	if err != nil {
+		return err
+	}
+	pubKeys := map[string]crypto.PubKey{}
+	powers := map[string]int64{}
+	var totalPower int64
+	for _, val := range vals {
+		pubKey, err := cryptoenc.PubKeyFromProto(val.PubKey)
+		if err != nil {
+			return err
+		}
+		pubKeys[string(pubKey.Address())] = pubKey
+		powers[string(pubKey.Address())] = val.Power
+		totalPower += val.Power
+	}
+
+	var exts []*voteExtension
+	var power int64
+	for _, vote := range otx.Votes {
+		pubKey, ok := pubKeys[string(vote.Validator)]
+		if !ok {
+			return fmt.Errorf("%X is not a validator or has more than one vote", vote.Validator)
+		}
+		delete(pubKeys, string(vote.Validator))
+		signBytes := cmttypes.VoteExtensionSignBytes(app.chainID, &cmtproto.Vote{
+			Extension: vote.Extension,
+			Height:    otx.Height,
+			Round:     otx.Round,
+		})
+		if !pubKey.VerifySignature(signBytes, vote.Signature) {
+			return fmt.Errorf("invalid vote extension signature of %X", vote.Validator)
+		}
+		ext, err := decodeVoteExtension(vote.Extension)
+		if err != nil {
+			return fmt.Errorf("vote extension of %X: %w", vote.Validator, err)
+		}
+		if ext.Height != otx.Height {
+			return fmt.Errorf("vote extension of %X is for height %d", vote.Validator, ext.Height)
+		}
+		exts = append(exts, ext)
+		power += powers[string(vote.Validator)]
+	}
+	if power*3 <= totalPower*2 {
+		return fmt.Errorf("vote extensions have %d of %d voting power, expected more than 2/3", power, totalPower)
+	}
+	if price := medianPrice(exts); otx.Price != price {
+		return fmt.Errorf("price %d is not the median price %d", otx.Price, price)
+	}
+	return nil
+}
+
+// execOracleTx stores the price of an oracle transaction of the block, checked by
+// ProcessProposal.
+func (app *KVStoreApplication) execOracleTx(b *blockExec, tx []byte) (*abcitypes.ExecTxResult, error) {
+	if b.index != 0 || !bytes.Equal(tx, b.tx) {
+		err := fmt.Errorf("oracle transaction must be the first transaction of the block, unwrapped, got tx %d", b.index)
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid oracle tx", "err", err)
+		return &abcitypes.ExecTxResult{Code: codeTypeInvalidOracleTx, Log: err.Error(), Codespace: codespace}, nil
+	}
+	otx, _ := parseOracleTx(tx)
+	if otx.Height != b.height-1 {
+		err := fmt.Errorf("oracle transaction is for height %d, expected %d", otx.Height, b.height-1)
+		app.logger.Error("abci", "method", "FinalizeBlock", "msg", "invalid oracle tx", "err", err)
+		return &abcitypes.ExecTxResult{Code: codeTypeInvalidOracleTx, Log: err.Error(), Codespace: codespace}, nil
+	}
+	price := strconv.FormatInt(otx.Price, 10)
+	if err := b.w.Set(oraclePriceKey, []byte(price)); err != nil {
+		return nil, err
+	}
+	if err := b.w.Set(oracleHeightKey, []byte(strconv.FormatInt(otx.Height, 10))); err != nil {
+		return nil, err
+	}
+	return &abcitypes.ExecTxResult{
+		Code: 0,
+		Events: []abcitypes.Event{
+			{
+				Type: "oracle",
+				Attributes: []abcitypes.EventAttribute{
+					{Key: "height", Value: strconv.FormatInt(otx.Height, 10), Index: true},
+					{Key: "price", Value: price, Index: true},
+					{Key: "votes", Value: strconv.Itoa(len(otx.Votes)), Index: true},
+				},
+			},
+		},
+	}, nil
+}
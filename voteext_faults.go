@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// VoteExtensionFaults make this node extend its votes with extensions that other nodes reject, or
+// reject the extensions of other nodes. They can be changed at runtime through the admin server.
+type VoteExtensionFaults struct {
+	// OversizedSize pads the extensions of this node with spaces up to this size in bytes, so
+	// that they are rejected if it exceeds maxVoteExtensionSize. Zero disables the padding.
+	OversizedSize int `json:"oversized_size"`
+
+	// Random makes the extensions of this node random bytes, which differ every time ExtendVote
+	// is called.
+	Random bool `json:"random"`
+
+	// RejectValidators are the hex addresses of the validators whose extensions this node
+	// rejects.
+	RejectValidators []string `json:"reject_validators"`
+
+	// RejectHeights are the heights at which this node rejects every extension.
+	RejectHeights []int64 `json:"reject_heights"`
+}
+
+func (f VoteExtensionFaults) validate() error {
+	if f.OversizedSize < 0 {
+		return fmt.Errorf("oversized size %d is negative", f.OversizedSize)
+	}
+	for _, addr := range f.RejectValidators {
+		if _, err := hex.DecodeString(addr); err != nil {
+			return fmt.Errorf("invalid validator address %q: %w", addr, err)
+		}
+	}
+	for _, height := range f.RejectHeights {
+		if height <= 0 {
+			return fmt.Errorf("height %d is not positive", height)
+		}
+	}
+	return nil
+}
+
+// extension returns the extension ext as it is sent under the faults.
+func (f VoteExtensionFaults) extension(ext []byte) ([]byte, error) {
+	if f.Random {
+		ext = make([]byte, 1+len(ext))
+		if _, err := rand.Read(ext); err != nil {
+			return nil, err
+		}
+	}
+	if len(ext) < f.OversizedSize {
+		// Trailing spaces keep JSON extensions well formed, only their size is wrong.
+		ext = append(ext, bytes.Repeat([]byte(" "), f.OversizedSize-len(ext))...)
+	}
+	return ext, nil
+}
+
+// rejection returns why the extension of the validator with the given address at height is
+// rejected under the faults, or "" if it is not.
+func (f VoteExtensionFaults) rejection(addr []byte, height int64) string {
+	if slices.Contains(f.RejectHeights, height) {
+		return fmt.Sprintf("rejecting vote extensions at height %d", height)
+	}
+	for _, reject := range f.RejectValidators {
+		if strings.EqualFold(reject, hex.EncodeToString(addr)) {
+			return fmt.Sprintf("rejecting vote extensions of %X", addr)
+		}
+	}
+	return ""
+}
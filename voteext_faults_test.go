@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+const voteExtensionsGenesis = `{"consensus_params": {"feature.vote_extensions_enable_height": "1"}}`
+
+func extendVote(t *testing.T, app *KVStoreApplication, height int64) []byte {
+	t.Helper()
+	resp, err := app.ExtendVote(context.Background(), &abcitypes.ExtendVoteRequest{Height: height})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.VoteExtension
+}
+
+func verifyVoteExtension(t *testing.T, app *KVStoreApplication, ext, addr []byte, height int64) abcitypes.VerifyVoteExtensionStatus {
+	t.Helper()
+	resp, err := app.VerifyVoteExtension(context.Background(), &abcitypes.VerifyVoteExtensionRequest{
+		VoteExtension:    ext,
+		ValidatorAddress: addr,
+		Height:           height,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status
+}
+
+func TestVoteExtensionFaults(t *testing.T) {
+	const (
+		accept = abcitypes.VERIFY_VOTE_EXTENSION_STATUS_ACCEPT
+		reject = abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT
+	)
+	peerAddr := []byte{0xAB, 0xCD}
+	testCases := []struct {
+		name     string
+		faults   VoteExtensionFaults
+		size     int                                 // the size of the extensions of the faulty node, if not 0
+		extended abcitypes.VerifyVoteExtensionStatus // the status of the extensions of the faulty node for its peer
+		verified abcitypes.VerifyVoteExtensionStatus // the status of the extensions of the peer for the faulty node
+	}{
+		{name: "none", extended: accept, verified: accept},
+		{name: "padded", faults: VoteExtensionFaults{OversizedSize: maxVoteExtensionSize}, size: maxVoteExtensionSize, extended: accept, verified: accept},
+		{name: "oversized", faults: VoteExtensionFaults{OversizedSize: maxVoteExtensionSize + 1}, size: maxVoteExtensionSize + 1, extended: reject, verified: accept},
+		{name: "random", faults: VoteExtensionFaults{Random: true}, extended: reject, verified: accept},
+		{name: "reject validator", faults: VoteExtensionFaults{RejectValidators: []string{"abcd"}}, extended: accept, verified: reject},
+		{name: "reject other validator", faults: VoteExtensionFaults{RejectValidators: []string{"ABCE"}}, extended: accept, verified: accept},
+		{name: "reject height", faults: VoteExtensionFaults{RejectHeights: []int64{1, 3}}, extended: accept, verified: reject},
+		{name: "reject other height", faults: VoteExtensionFaults{RejectHeights: []int64{2}}, extended: accept, verified: accept},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.VoteExtensionFaults = tc.faults
+			node := newTestApp(t, cfg)
+			initChain(t, node, voteExtensionsGenesis)
+			peer := newTestApp(t, DefaultConfig())
+			initChain(t, peer, voteExtensionsGenesis)
+
+			ext := extendVote(t, node, 1)
+			if tc.size != 0 && len(ext) != tc.size {
+				t.Fatalf("extension of %d bytes, want %d", len(ext), tc.size)
+			}
+			if status := verifyVoteExtension(t, peer, ext, []byte{0x01}, 1); status != tc.extended {
+				t.Fatalf("extension of the faulty node %v, want %v", status, tc.extended)
+			}
+			if tc.faults.Random && bytes.Equal(ext, extendVote(t, node, 1)) {
+				t.Fatal("random extensions do not change")
+			}
+			if status := verifyVoteExtension(t, node, extendVote(t, peer, 1), peerAddr, 1); status != tc.verified {
+				t.Fatalf("extension of the peer %v, want %v", status, tc.verified)
+			}
+		})
+	}
+}
+
+func TestVoteExtensionFaultsAdmin(t *testing.T) {
+	node := newTestApp(t, DefaultConfig())
+	initChain(t, node, voteExtensionsGenesis)
+	peer := newTestApp(t, DefaultConfig())
+	initChain(t, peer, voteExtensionsGenesis)
+	const path = "/faults/vote-extensions"
+
+	putFault(t, node, path, `{"random": true, "reject_heights": [1]}`)
+	if status := verifyVoteExtension(t, peer, extendVote(t, node, 1), []byte{0x01}, 1); status != abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT {
+		t.Fatalf("random extension %v", status)
+	}
+	if status := verifyVoteExtension(t, node, extendVote(t, peer, 1), []byte{0x02}, 1); status != abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT {
+		t.Fatalf("extension at a rejected height %v", status)
+	}
+	if w := adminRequest(t, node, http.MethodGet, path, ""); w.Code != http.StatusOK || w.Body.String() != `{"oversized_size":0,"random":true,"reject_validators":null,"reject_heights":[1]}`+"\n" {
+		t.Fatalf("GET: status %d: %s", w.Code, w.Body)
+	}
+
+	// Invalid faults leave the current ones.
+	for _, body := range []string{`{"oversized_size": -1}`, `{"reject_heights": [0]}`, `{"reject_validators": ["xyz"]}`, `{"unknown": 1}`, `{`} {
+		if w := adminRequest(t, node, http.MethodPut, path, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if !node.voteExtensionFaults.Load().Random {
+		t.Fatal("faults changed by an invalid request")
+	}
+	if w := adminRequest(t, node, http.MethodPost, path, `{}`); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	putFault(t, node, path, `{}`)
+	if status := verifyVoteExtension(t, peer, extendVote(t, node, 1), []byte{0x01}, 1); status != abcitypes.VERIFY_VOTE_EXTENSION_STATUS_ACCEPT {
+		t.Fatalf("extension after the faults are cleared %v", status)
+	}
+	if status := verifyVoteExtension(t, node, extendVote(t, peer, 1), []byte{0x02}, 1); status != abcitypes.VERIFY_VOTE_EXTENSION_STATUS_ACCEPT {
+		t.Fatalf("extension after the faults are cleared %v", status)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// newOracleTx returns the oracle transaction of the vote extensions of height signed by privs.
+func newOracleTx(t *testing.T, height int64, privs ...crypto.PrivKey) []byte {
+	t.Helper()
+	otx := oracleTx{Height: height, Price: 100}
+	for _, priv := range privs {
+		ext, err := json.Marshal(voteExtension{Height: height, Price: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := priv.Sign(cmttypes.VoteExtensionSignBytes(testChainID, &cmtproto.Vote{Extension: ext, Height: height}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		otx.Votes = append(otx.Votes, oracleVote{Validator: priv.PubKey().Address(), Extension: ext, Signature: sig})
+	}
+	bz, err := json.Marshal(otx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(oracleTxPrefix), bz...)
+}
+
+func TestOracleTxValidatorsAfterRestore(t *testing.T) {
+	priv1, priv2 := ed25519.GenPrivKey(), ed25519.GenPrivKey()
+	genesisVals := []abcitypes.ValidatorUpdate{abcitypes.UpdateValidator(priv1.PubKey().Bytes(), 10, ed25519.KeyType)}
+	const genesis = `{"consensus_params": {"feature.vote_extensions_enable_height": "1"}}`
+
+	// The validator added at height 1 votes from height 3 on.
+	source := newTestApp(t, DefaultConfig())
+	initChain(t, source, genesis, genesisVals...)
+	commitBlock(t, source, 1, fmt.Sprintf("val:%s!10", base64.StdEncoding.EncodeToString(priv2.PubKey().Bytes())))
+	for height := int64(2); height <= 4; height++ {
+		commitBlock(t, source, height)
+	}
+
+	// The restored node holds none of the versions below the snapshot.
+	target := newTestApp(t, DefaultConfig())
+	initChain(t, target, genesis, genesisVals...)
+	restoreSnapshot(t, source, target, 4)
+
+	testCases := []struct {
+		name   string
+		height int64 // the height of the vote extensions
+		privs  []crypto.PrivKey
+		valid  bool
+	}{
+		{name: "genesis validator", height: 2, privs: []crypto.PrivKey{priv1}, valid: true},
+		{name: "validator before it applies", height: 2, privs: []crypto.PrivKey{priv1, priv2}, valid: false},
+		{name: "all validators", height: 4, privs: []crypto.PrivKey{priv1, priv2}, valid: true},
+		{name: "half of the power", height: 4, privs: []crypto.PrivKey{priv1}, valid: false},
+		{name: "added validator alone", height: 4, privs: []crypto.PrivKey{priv2}, valid: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := newOracleTx(t, tc.height, tc.privs...)
+			for name, app := range map[string]*KVStoreApplication{"source": source, "restored": target} {
+				err := app.verifyOracleTx(tx, tc.height+1)
+				if tc.valid && err != nil {
+					t.Fatalf("%s: expected a valid oracle tx, got %v", name, err)
+				}
+				if !tc.valid && err == nil {
+					t.Fatalf("%s: expected an invalid oracle tx", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareFirstProposal(t *testing.T) {
+	app := newTestApp(t, DefaultConfig())
+	initChain(t, app, `{"consensus_params": {"feature.vote_extensions_enable_height": "1"}}`)
+	// The first block has no last commit, so no vote extensions to aggregate.
+	resp, err := app.PrepareProposal(context.Background(), &abcitypes.PrepareProposalRequest{Height: 1, MaxTxBytes: 1 << 20, Txs: [][]byte{[]byte("a=1")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Txs) != 1 || string(resp.Txs[0]) != "a=1" {
+		t.Fatalf("proposal %q, want only the mempool tx", resp.Txs)
+	}
+}
+
+func TestProcessProposalOracleTx(t *testing.T) {
+	priv := ed25519.GenPrivKey()
+	app := newTestApp(t, DefaultConfig())
+	initChain(t, app, `{"consensus_params": {"feature.vote_extensions_enable_height": "2"}}`,
+		abcitypes.UpdateValidator(priv.PubKey().Bytes(), 10, ed25519.KeyType))
+	for height := int64(1); height <= 4; height++ {
+		commitBlock(t, app, height)
+	}
+
+	testCases := []struct {
+		name   string
+		height int64
+		txs    [][]byte
+		accept bool
+	}{
+		{name: "oracle tx", height: 5, txs: [][]byte{newOracleTx(t, 4, priv), []byte("a=2")}, accept: true},
+		{name: "missing oracle tx", height: 5, txs: [][]byte{[]byte("a=2")}},
+		{name: "empty proposal", height: 5},
+		{name: "oracle tx after another tx", height: 5, txs: [][]byte{[]byte("a=2"), newOracleTx(t, 4, priv)}},
+		{name: "oracle tx of another height", height: 5, txs: [][]byte{newOracleTx(t, 3, priv)}},
+		{name: "before vote extensions", height: 2, txs: [][]byte{[]byte("a=2")}, accept: true},
+		{name: "oracle tx before vote extensions", height: 2, txs: [][]byte{newOracleTx(t, 1, priv)}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := app.ProcessProposal(context.Background(), &abcitypes.ProcessProposalRequest{Height: tc.height, Txs: tc.txs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted := resp.Status == abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT; accepted != tc.accept {
+				t.Fatalf("status %v, want accepted %v", resp.Status, tc.accept)
+			}
+		})
+	}
+}